@@ -0,0 +1,94 @@
+// Package bgzf implements the BGZF (blocked gzip) format used by BAM, tabix and
+// other genomics file formats. A BGZF file is a series of gzip members of at
+// most 64KiB each. Each member has an extra subfield "BC" that stores the size
+// of the member, so a reader can locate the members without decompressing them.
+// A position in a BGZF file is expressed as a VirtualOffset. See the SAM/BAM
+// format specification (https://samtools.github.io/hts-specs/SAMv1.pdf),
+// section 4.1, for the details.
+//
+// The Writer and the Reader compress and decompress blocks in parallel.
+package bgzf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxBlockSize is the maximum size of a compressed BGZF block, including the
+	// gzip header and trailer.
+	MaxBlockSize = 64 * 1024
+	// MaxDataSize is the maximum number of uncompressed bytes that Writer stores
+	// in a block. It is the same value as htslib's BGZF_BLOCK_SIZE, which
+	// guarantees that the compressed block fits in MaxBlockSize even when the
+	// data is incompressible.
+	MaxDataSize = 0xff00
+
+	// headerSize is the size of the gzip header written by Writer. The BC
+	// subfield is the only extra subfield.
+	headerSize = 18
+	// trailerSize is the size of the gzip trailer (CRC32 and ISIZE).
+	trailerSize = 8
+)
+
+// EOFMarker is the empty block that terminates a BGZF file.
+var EOFMarker = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+	0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+// bcExtra is the value of GzipHeader.Extra of a BGZF block. The last two bytes
+// hold the block size minus one. They are filled after compression.
+var bcExtra = []byte{'B', 'C', 2, 0, 0, 0}
+
+// ErrCorrupt is returned when the input is not a valid BGZF stream.
+var ErrCorrupt = errors.New("bgzf: corrupt block")
+
+// VirtualOffset is a BGZF virtual file offset. Its upper 48 bits are the file
+// offset of the start of a block (coffset), and the lower 16 bits are the offset
+// within the uncompressed contents of the block (uoffset).
+type VirtualOffset uint64
+
+// MakeVirtualOffset creates a VirtualOffset from a block offset and an offset
+// within the block.
+func MakeVirtualOffset(coffset int64, uoffset int) VirtualOffset {
+	return VirtualOffset(coffset)<<16 | VirtualOffset(uoffset&0xffff)
+}
+
+// Compressed returns the file offset of the start of the block.
+func (v VirtualOffset) Compressed() int64 { return int64(v >> 16) }
+
+// Uncompressed returns the offset within the uncompressed block.
+func (v VirtualOffset) Uncompressed() int { return int(v & 0xffff) }
+
+// String implements fmt.Stringer.
+func (v VirtualOffset) String() string {
+	return fmt.Sprintf("%d:%d", v.Compressed(), v.Uncompressed())
+}
+
+// parseBlockSize parses the gzip header at the start of a block, and returns
+// the total size of the block. The header must contain the complete extra
+// field.
+func parseBlockSize(header []byte) (int, error) {
+	if len(header) < 12 || header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&4 == 0 {
+		return 0, ErrCorrupt
+	}
+	xlen := int(binary.LittleEndian.Uint16(header[10:12]))
+	if len(header) < 12+xlen {
+		return 0, ErrCorrupt
+	}
+	for extra := header[12 : 12+xlen]; len(extra) >= 4; {
+		slen := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+slen {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int(binary.LittleEndian.Uint16(extra[4:6])) + 1, nil
+		}
+		extra = extra[4+slen:]
+	}
+	return 0, ErrCorrupt
+}
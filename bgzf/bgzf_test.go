@@ -0,0 +1,170 @@
+package bgzf_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/yasushi-saito/zlibng/bgzf"
+)
+
+func testData(r *rand.Rand, n int) []byte {
+	words := []string{"chr1", "chr2", "ACGT", "TTAGGG", "\t", "\n", "12345"}
+	buf := bytes.Buffer{}
+	for buf.Len() < n {
+		if r.Intn(10) == 0 {
+			var b [16]byte
+			_, _ = r.Read(b[:])
+			buf.Write(b[:])
+		} else {
+			buf.WriteString(words[r.Intn(len(words))])
+		}
+	}
+	return buf.Bytes()[:n]
+}
+
+func compress(t *testing.T, data []byte, concurrency int) []byte {
+	out := bytes.Buffer{}
+	w, err := bgzf.NewWriter(&out, 5, concurrency)
+	assert.NoError(t, err)
+	for len(data) > 0 {
+		n := len(data)
+		if n > 12345 {
+			n = 12345
+		}
+		_, err := w.Write(data[:n])
+		assert.NoError(t, err)
+		data = data[n:]
+	}
+	assert.NoError(t, w.Close())
+	return out.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{0, 1, bgzf.MaxDataSize, 3*bgzf.MaxDataSize + 1, 1 << 20} {
+		t.Run(fmt.Sprintf("%d", n), func(t *testing.T) {
+			data := testData(r, n)
+			compressed := compress(t, data, 4)
+			assert.True(t, bytes.HasSuffix(compressed, bgzf.EOFMarker))
+			// The output must be readable as a regular multi-member gzip file.
+			gz, err := gzip.NewReader(bytes.NewReader(compressed))
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+
+			for _, concurrency := range []int{1, 3} {
+				assert.True(t, bytes.Equal(compress(t, data, concurrency), compressed))
+				zr, err := bgzf.NewReader(bytes.NewReader(compressed), concurrency)
+				assert.NoError(t, err)
+				got, err := ioutil.ReadAll(zr)
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(got, data))
+				assert.NoError(t, zr.Close())
+			}
+		})
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 4*bgzf.MaxDataSize)
+	_, err := r.Read(data)
+	assert.NoError(t, err)
+	for _, level := range []int{-1, 0, 1, 9} {
+		out := bytes.Buffer{}
+		w, err := bgzf.NewWriter(&out, level, 2)
+		assert.NoError(t, err)
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close(), "level=%d", level)
+
+		zr, err := bgzf.NewReader(bytes.NewReader(out.Bytes()), 2)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data), "level=%d", level)
+		assert.NoError(t, zr.Close())
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	out := bytes.Buffer{}
+	w, err := bgzf.NewWriter(&out, 5, 2)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	_, err = w.Write(make([]byte, 1<<20))
+	assert.Regexp(t, err, "writer is closed")
+	assert.Regexp(t, w.Flush(), "writer is closed")
+	assert.Regexp(t, w.Close(), "writer is closed")
+
+	zr, err := bgzf.NewReader(bytes.NewReader(out.Bytes()), 2)
+	assert.NoError(t, err)
+	assert.NoError(t, zr.Close())
+	_, err = zr.Read(make([]byte, 10))
+	assert.Regexp(t, err, "reader is closed")
+	assert.Regexp(t, zr.Seek(0), "reader is closed")
+	assert.NoError(t, zr.Close())
+}
+
+func TestSeek(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := testData(r, 1<<20)
+	compressed := compress(t, data, 4)
+
+	// Record the virtual offsets of random positions.
+	zr, err := bgzf.NewReader(bytes.NewReader(compressed), 2)
+	assert.NoError(t, err)
+	type position struct {
+		voff bgzf.VirtualOffset
+		off  int
+	}
+	var positions []position
+	off := 0
+	for {
+		positions = append(positions, position{zr.Tell(), off})
+		buf := make([]byte, r.Intn(100000))
+		n, err := io.ReadFull(zr, buf)
+		assert.True(t, bytes.Equal(buf[:n], data[off:off+n]))
+		off += n
+		if err != nil {
+			assert.True(t, err == io.EOF || err == io.ErrUnexpectedEOF)
+			break
+		}
+	}
+	assert.EQ(t, off, len(data))
+
+	r.Shuffle(len(positions), func(i, j int) { positions[i], positions[j] = positions[j], positions[i] })
+	for _, p := range positions {
+		assert.NoError(t, zr.Seek(p.voff))
+		assert.EQ(t, zr.Tell(), p.voff)
+		n := len(data) - p.off
+		if n > 1000 {
+			n = 1000
+		}
+		buf := make([]byte, n)
+		_, err := io.ReadFull(zr, buf)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(buf, data[p.off:p.off+n]), "voff %v", p.voff)
+	}
+	assert.NoError(t, zr.Close())
+}
+
+func TestCorrupt(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	compressed := compress(t, testData(r, 200000), 2)
+	compressed[100] ^= 0xff
+	zr, err := bgzf.NewReader(bytes.NewReader(compressed), 2)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zr)
+	assert.NotNil(t, err)
+	assert.NotNil(t, zr.Close())
+}
@@ -0,0 +1,329 @@
+package bgzf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/yasushi-saito/zlibng"
+)
+
+// errReaderClosed is returned by the methods of a closed Reader.
+var errReaderClosed = errors.New("bgzf: reader is closed")
+
+// readBlock is a unit of decompression in Reader.
+type readBlock struct {
+	coffset int64  // file offset of the block.
+	raw     []byte // compressed block.
+	data    []byte // uncompressed data, filled by a worker.
+	err     error
+	done    chan struct{}
+}
+
+// Reader reads a BGZF file. Blocks are read ahead and decompressed on multiple
+// goroutines. It implements io.ReadCloser.
+type Reader struct {
+	in          io.Reader
+	concurrency int
+
+	coffset int64        // file offset of the next block to be read from in.
+	inEOF   bool         // true if in reached io.EOF.
+	cur     *readBlock   // block being consumed by Read.
+	uoffset int          // offset of the next byte in cur.data.
+	pending []*readBlock // blocks submitted to the workers, in file order.
+	free    []*readBlock // blocks that can be reused.
+	work    chan *readBlock
+	wg      sync.WaitGroup
+
+	closed bool
+	err    error
+}
+
+// NewReader creates a BGZF reader that decompresses blocks using up to
+// concurrency goroutines. If concurrency <= 0, runtime.NumCPU() is used. Seek
+// requires in to implement io.Seeker.
+func NewReader(in io.Reader, concurrency int) (*Reader, error) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	z := &Reader{
+		in:          in,
+		concurrency: concurrency,
+		work:        make(chan *readBlock, concurrency),
+	}
+	z.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go z.runWorker()
+	}
+	return z, nil
+}
+
+// Read implements io.Reader.
+func (z *Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && z.err == nil {
+		if z.cur == nil || z.uoffset >= len(z.cur.data) {
+			if n > 0 {
+				// Don't block on the next block if we already have some data.
+				break
+			}
+			z.nextBlock()
+			continue
+		}
+		m := copy(p[n:], z.cur.data[z.uoffset:])
+		z.uoffset += m
+		n += m
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, z.err
+}
+
+// Tell returns the virtual offset of the next byte returned by Read.
+func (z *Reader) Tell() VirtualOffset {
+	if z.cur == nil {
+		return MakeVirtualOffset(z.coffset, 0)
+	}
+	if z.uoffset >= len(z.cur.data) {
+		return MakeVirtualOffset(z.cur.coffset+int64(len(z.cur.raw)), 0)
+	}
+	return MakeVirtualOffset(z.cur.coffset, z.uoffset)
+}
+
+// Seek moves the read position to the given virtual offset. It requires the
+// underlying reader to implement io.Seeker.
+func (z *Reader) Seek(off VirtualOffset) error {
+	seeker, ok := z.in.(io.Seeker)
+	if !ok {
+		return errors.New("bgzf.Seek: the underlying reader does not implement io.Seeker")
+	}
+	if z.closed {
+		return errReaderClosed
+	}
+	if z.err != nil && z.err != io.EOF {
+		return z.err
+	}
+	// Discard the blocks that were read ahead.
+	for _, blk := range z.pending {
+		<-blk.done
+		z.free = append(z.free, blk)
+	}
+	z.pending = z.pending[:0]
+	if z.cur != nil {
+		z.free = append(z.free, z.cur)
+		z.cur = nil
+	}
+	z.uoffset = 0
+	z.inEOF = false
+	z.err = nil
+	if _, err := seeker.Seek(off.Compressed(), io.SeekStart); err != nil {
+		z.err = err
+		return err
+	}
+	z.coffset = off.Compressed()
+	if off.Uncompressed() == 0 {
+		return nil
+	}
+	z.nextBlock()
+	if z.err != nil {
+		return z.err
+	}
+	if off.Uncompressed() > len(z.cur.data) {
+		z.err = errors.New("bgzf.Seek: offset is beyond the end of the block")
+		return z.err
+	}
+	z.uoffset = off.Uncompressed()
+	return nil
+}
+
+// Close stops the worker goroutines. It does not close the underlying reader.
+func (z *Reader) Close() error {
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	for _, blk := range z.pending {
+		<-blk.done
+	}
+	z.pending = nil
+	close(z.work)
+	z.wg.Wait()
+	err := z.err
+	// Later calls must not send blocks to the stopped workers.
+	z.err = errReaderClosed
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// nextBlock makes the next block with a nonempty error or data the current one.
+// It sets z.err on error or at the end of the input.
+func (z *Reader) nextBlock() {
+	if z.cur != nil {
+		z.free = append(z.free, z.cur)
+		z.cur = nil
+	}
+	z.uoffset = 0
+	for z.err == nil {
+		z.fill()
+		if len(z.pending) == 0 {
+			z.err = io.EOF
+			return
+		}
+		blk := z.pending[0]
+		z.pending = z.pending[1:]
+		<-blk.done
+		if blk.err != nil {
+			z.err = blk.err
+			z.free = append(z.free, blk)
+			return
+		}
+		if len(blk.data) > 0 {
+			z.cur = blk
+			return
+		}
+		z.free = append(z.free, blk) // empty block, e.g., the EOF marker.
+	}
+}
+
+// fill reads blocks from the underlying reader and submits them to the workers
+// until concurrency blocks are pending.
+func (z *Reader) fill() {
+	for !z.inEOF && len(z.pending) < z.concurrency {
+		blk := z.newBlock()
+		if err := z.readRawBlock(blk); err != nil {
+			z.free = append(z.free, blk)
+			if err == io.EOF {
+				z.inEOF = true
+				return
+			}
+			// Report the error after the blocks that precede it.
+			blk = z.newBlock()
+			blk.err = err
+			blk.done = make(chan struct{})
+			close(blk.done)
+			z.pending = append(z.pending, blk)
+			z.inEOF = true
+			return
+		}
+		blk.done = make(chan struct{})
+		z.pending = append(z.pending, blk)
+		z.work <- blk
+	}
+}
+
+func (z *Reader) newBlock() *readBlock {
+	if n := len(z.free); n > 0 {
+		blk := z.free[n-1]
+		z.free = z.free[:n-1]
+		blk.err = nil
+		return blk
+	}
+	return &readBlock{}
+}
+
+// readRawBlock reads the next compressed block from the underlying reader. It
+// returns io.EOF if there are no more blocks.
+func (z *Reader) readRawBlock(blk *readBlock) error {
+	const fixedHeaderSize = 12 // gzip header up to XLEN.
+	if cap(blk.raw) < MaxBlockSize {
+		blk.raw = make([]byte, MaxBlockSize)
+	}
+	raw := blk.raw[:MaxBlockSize]
+	if n, err := io.ReadFull(z.in, raw[:fixedHeaderSize]); err != nil {
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && n == 0) {
+			return io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return ErrCorrupt
+		}
+		return err
+	}
+	xlen := int(binary.LittleEndian.Uint16(raw[10:12]))
+	if fixedHeaderSize+xlen > MaxBlockSize {
+		return ErrCorrupt
+	}
+	if _, err := io.ReadFull(z.in, raw[fixedHeaderSize:fixedHeaderSize+xlen]); err != nil {
+		return noEOF(err)
+	}
+	size, err := parseBlockSize(raw[:fixedHeaderSize+xlen])
+	if err != nil {
+		return err
+	}
+	if size < fixedHeaderSize+xlen+trailerSize {
+		return ErrCorrupt
+	}
+	if _, err := io.ReadFull(z.in, raw[fixedHeaderSize+xlen:size]); err != nil {
+		return noEOF(err)
+	}
+	blk.raw = raw[:size]
+	blk.coffset = z.coffset
+	z.coffset += int64(size)
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
+
+func (z *Reader) runWorker() {
+	defer z.wg.Done()
+	var zr *zlibng.Reader
+	for blk := range z.work {
+		zr, blk.err = z.decompress(zr, blk)
+		close(blk.done)
+	}
+	if zr != nil {
+		_ = zr.Close()
+	}
+}
+
+// decompress decompresses blk.raw into blk.data. zr is the worker's gzip
+// reader, or nil on the first call. It returns the reader to use for the next
+// block.
+func (z *Reader) decompress(zr *zlibng.Reader, blk *readBlock) (*zlibng.Reader, error) {
+	size := int(binary.LittleEndian.Uint32(blk.raw[len(blk.raw)-4:])) // ISIZE
+	if size > MaxBlockSize {
+		return zr, ErrCorrupt
+	}
+	if cap(blk.data) < size {
+		blk.data = make([]byte, size, MaxBlockSize)
+	}
+	blk.data = blk.data[:size]
+	src := bytes.NewReader(blk.raw)
+	if zr == nil {
+		r, err := zlibng.NewReader(src, zlibng.Opts{WindowBits: zlibng.Gzip, Buffer: MaxBlockSize})
+		if err != nil {
+			return nil, err
+		}
+		zr = r
+	} else if err := zr.Reset(src); err != nil {
+		return zr, err
+	}
+	if _, err := io.ReadFull(zr, blk.data); err != nil {
+		return zr, noEOF(err)
+	}
+	// The block must end exactly at ISIZE. Reading until EOF also makes zlib
+	// verify the CRC in the trailer.
+	var extra [1]byte
+	for {
+		n, err := zr.Read(extra[:])
+		if n != 0 {
+			return zr, ErrCorrupt
+		}
+		if err == io.EOF {
+			return zr, nil
+		}
+		if err != nil {
+			return zr, err
+		}
+	}
+}
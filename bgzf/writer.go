@@ -0,0 +1,223 @@
+package bgzf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/yasushi-saito/zlibng"
+)
+
+// errWriterClosed is returned by the methods of a closed Writer.
+var errWriterClosed = errors.New("bgzf: writer is closed")
+
+// writeBlock is a unit of compression in Writer.
+type writeBlock struct {
+	data []byte       // uncompressed data.
+	out  bytes.Buffer // compressed block, filled by a worker.
+	err  error
+	done chan struct{}
+}
+
+// Writer writes a BGZF file. Blocks are compressed on multiple goroutines. It
+// implements io.WriteCloser.
+type Writer struct {
+	out         io.Writer
+	level       int
+	concurrency int
+
+	block   *writeBlock   // block being filled by Write.
+	pending []*writeBlock // blocks submitted to the workers, in file order.
+	free    []*writeBlock // blocks that can be reused.
+	work    chan *writeBlock
+	wg      sync.WaitGroup
+
+	closed bool
+	err    error
+}
+
+// NewWriter creates a BGZF writer that compresses blocks at the given zlib
+// level, using up to concurrency goroutines. If concurrency <= 0,
+// runtime.NumCPU() is used.
+func NewWriter(w io.Writer, level, concurrency int) (*Writer, error) {
+	if level < -1 || level > 9 {
+		return nil, errors.New("bgzf.NewWriter: invalid compression level")
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	z := &Writer{
+		out:         w,
+		level:       level,
+		concurrency: concurrency,
+		work:        make(chan *writeBlock, concurrency),
+	}
+	z.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go z.runWorker()
+	}
+	return z, nil
+}
+
+// Write implements io.Writer.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if z.block == nil {
+			z.block = z.newBlock()
+		}
+		m := MaxDataSize - len(z.block.data)
+		if m > len(p) {
+			m = len(p)
+		}
+		z.block.data = append(z.block.data, p[:m]...)
+		p = p[m:]
+		if len(z.block.data) == MaxDataSize {
+			if err := z.submit(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush ends the current block and writes all the pending blocks to the
+// underlying writer. After Flush, the next Write starts a new block.
+func (z *Writer) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.block != nil && len(z.block.data) > 0 {
+		if err := z.submit(); err != nil {
+			return err
+		}
+	}
+	for len(z.pending) > 0 && z.err == nil {
+		z.writePending()
+	}
+	return z.err
+}
+
+// Close flushes the data, writes the EOF marker, and stops the worker
+// goroutines. It does not close the underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	if err := z.Flush(); err == nil {
+		_, z.err = z.out.Write(EOFMarker)
+	}
+	z.closed = true
+	close(z.work)
+	z.wg.Wait()
+	err := z.err
+	if err == nil {
+		// Later calls must not send blocks to the stopped workers.
+		z.err = errWriterClosed
+	}
+	return err
+}
+
+func (z *Writer) newBlock() *writeBlock {
+	if n := len(z.free); n > 0 {
+		blk := z.free[n-1]
+		z.free = z.free[:n-1]
+		blk.data = blk.data[:0]
+		return blk
+	}
+	return &writeBlock{data: make([]byte, 0, MaxDataSize)}
+}
+
+// submit sends z.block to the workers. If too many blocks are pending, it waits
+// for the oldest one and writes it to the output.
+func (z *Writer) submit() error {
+	blk := z.block
+	z.block = nil
+	blk.done = make(chan struct{})
+	z.pending = append(z.pending, blk)
+	z.work <- blk
+	for len(z.pending) > 2*z.concurrency && z.err == nil {
+		z.writePending()
+	}
+	return z.err
+}
+
+// writePending waits for the oldest pending block and writes it to the output.
+func (z *Writer) writePending() {
+	blk := z.pending[0]
+	z.pending = z.pending[1:]
+	<-blk.done
+	if z.err = blk.err; z.err != nil {
+		return
+	}
+	if _, z.err = z.out.Write(blk.out.Bytes()); z.err != nil {
+		return
+	}
+	z.free = append(z.free, blk)
+}
+
+func (z *Writer) runWorker() {
+	defer z.wg.Done()
+	var zw *zlibng.Writer
+	for blk := range z.work {
+		zw, blk.err = z.compress(zw, blk)
+		close(blk.done)
+	}
+	if zw != nil {
+		_ = zw.Close()
+	}
+}
+
+// compress compresses blk.data into a BGZF block. zw is the worker's gzip
+// writer, or nil on the first call. It returns the writer to use for the next
+// block.
+func (z *Writer) compress(zw *zlibng.Writer, blk *writeBlock) (*zlibng.Writer, error) {
+	zw, err := deflateBlock(zw, blk, z.level)
+	if err != nil {
+		return zw, err
+	}
+	if blk.out.Len() > MaxBlockSize && z.level != 0 {
+		// MaxDataSize relies on deflate falling back to stored blocks for
+		// incompressible data, but level 1 (deflate_quick) always uses the static
+		// Huffman codes. Store the data instead, as htslib does.
+		if zw, err = deflateBlock(zw, blk, 0); err != nil {
+			return zw, err
+		}
+	}
+	b := blk.out.Bytes()
+	if len(b) > MaxBlockSize || len(b) < headerSize+trailerSize || !bytes.Equal(b[12:16], bcExtra[:4]) {
+		return zw, errors.New("bgzf: failed to produce a block")
+	}
+	binary.LittleEndian.PutUint16(b[16:18], uint16(len(b)-1))
+	return zw, nil
+}
+
+// deflateBlock compresses blk.data into blk.out as a gzip member with the BC
+// subfield, at the given level. zw is reset, or created if it is nil, and
+// returned. Finish keeps its deflate state for the next block.
+func deflateBlock(zw *zlibng.Writer, blk *writeBlock, level int) (*zlibng.Writer, error) {
+	blk.out.Reset()
+	opt := zlibng.Opts{Level: level, Buffer: MaxBlockSize}
+	if zw == nil {
+		w, err := zlibng.NewWriter(&blk.out, opt)
+		if err != nil {
+			return nil, err
+		}
+		zw = w
+	} else if err := zw.Reset(&blk.out, opt); err != nil {
+		return zw, err
+	}
+	if err := zw.SetHeader(zlibng.GzipHeader{Extra: bcExtra, OS: 255}); err != nil {
+		return zw, err
+	}
+	if _, err := zw.Write(blk.data); err != nil {
+		return zw, err
+	}
+	return zw, zw.Finish()
+}
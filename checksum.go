@@ -0,0 +1,97 @@
+package zlibng
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// CRC32CombineOp is an operator created by MakeCRC32CombineOp. It is useful when
+// many checksums of byte sequences of the same length are combined; applying the
+// operator is much faster than CRC32Combine.
+type CRC32CombineOp [32]uint32
+
+// parallelCRC32ChunkSize is the unit of work in ParallelCRC32.
+const parallelCRC32ChunkSize = 4 << 20
+
+// ParallelCRC32 computes the CRC-32 (IEEE) checksum of the first size bytes of
+// r. The data is read in chunks, and the chunks are checksummed on up to
+// workers goroutines. If workers <= 0, runtime.NumCPU() is used.
+func ParallelCRC32(r io.ReaderAt, size int64, workers int) (uint32, error) {
+	if size < 0 {
+		return 0, errors.New("zlibng.ParallelCRC32: negative size")
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	nChunks := int((size + parallelCRC32ChunkSize - 1) / parallelCRC32ChunkSize)
+	if workers > nChunks {
+		workers = nChunks
+	}
+	var (
+		crcs  = make([]uint32, nChunks)
+		mu    sync.Mutex
+		next  int // next chunk to be read
+		err   error
+		wg    sync.WaitGroup
+		chunk = func(i int) (int64, int) {
+			off := int64(i) * parallelCRC32ChunkSize
+			n := size - off
+			if n > parallelCRC32ChunkSize {
+				n = parallelCRC32ChunkSize
+			}
+			return off, int(n)
+		}
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, parallelCRC32ChunkSize)
+			for {
+				mu.Lock()
+				i := next
+				next++
+				stop := err != nil || i >= nChunks
+				mu.Unlock()
+				if stop {
+					return
+				}
+				off, n := chunk(i)
+				m, e := r.ReadAt(buf[:n], off)
+				if m == n {
+					// io.ReaderAt may return io.EOF at the end of the data.
+					e = nil
+				} else if e == nil || e == io.EOF {
+					e = io.ErrUnexpectedEOF
+				}
+				if e != nil {
+					mu.Lock()
+					if err == nil {
+						err = e
+					}
+					mu.Unlock()
+					return
+				}
+				crcs[i] = ChecksumCRC32(buf[:n])
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		op  = MakeCRC32CombineOp(parallelCRC32ChunkSize)
+		crc uint32
+	)
+	for i, c := range crcs {
+		if _, n := chunk(i); n == parallelCRC32ChunkSize {
+			crc = op.Combine(crc, c)
+		} else {
+			crc = CRC32Combine(crc, c, int64(n))
+		}
+	}
+	return crc, nil
+}
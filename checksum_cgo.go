@@ -0,0 +1,134 @@
+// +build cgo,amd64
+
+package zlibng
+
+/*
+#include "./zlib-ng.h"
+*/
+import "C"
+
+import (
+	"hash"
+	"unsafe"
+)
+
+// checksumBatchSize is the size of the buffer used by the hash.Hash32
+// implementations. Writes smaller than this are buffered, so that each cgo call
+// processes a reasonable amount of data.
+const checksumBatchSize = 4096
+
+// ChecksumCRC32 returns the CRC-32 checksum of data, using the IEEE polynomial.
+// It is the same as crc32.ChecksumIEEE.
+func ChecksumCRC32(data []byte) uint32 {
+	return crc32Update(0, data)
+}
+
+// ChecksumAdler32 returns the Adler-32 checksum of data. It is the same as
+// adler32.Checksum.
+func ChecksumAdler32(data []byte) uint32 {
+	return adler32Update(1, data)
+}
+
+// NewCRC32 creates a hash.Hash32 that computes the CRC-32 checksum using the
+// IEEE polynomial. It is the same as crc32.NewIEEE, but faster for large
+// inputs.
+func NewCRC32() hash.Hash32 {
+	return &checksum{init: 0, sum: 0, blockSize: 1, update: crc32Update}
+}
+
+// NewAdler32 creates a hash.Hash32 that computes the Adler-32 checksum. It is
+// the same as adler32.New, but faster for large inputs.
+func NewAdler32() hash.Hash32 {
+	return &checksum{init: 1, sum: 1, blockSize: 4, update: adler32Update}
+}
+
+func crc32Update(crc uint32, data []byte) uint32 {
+	if len(data) == 0 {
+		return crc
+	}
+	return uint32(C.zng_crc32_z(C.uint32_t(crc), (*C.uchar)(unsafe.Pointer(&data[0])), C.size_t(len(data))))
+}
+
+func adler32Update(adler uint32, data []byte) uint32 {
+	if len(data) == 0 {
+		return adler
+	}
+	return uint32(C.zng_adler32_z(C.uint32_t(adler), (*C.uchar)(unsafe.Pointer(&data[0])), C.size_t(len(data))))
+}
+
+// CRC32Combine returns the CRC-32 checksum of the concatenation of two byte
+// sequences, given the checksums crc1 and crc2 of the sequences, and the length
+// of the second sequence.
+func CRC32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	return uint32(C.zng_crc32_combine(C.uint32_t(crc1), C.uint32_t(crc2), C.z_off64_t(len2)))
+}
+
+// Adler32Combine returns the Adler-32 checksum of the concatenation of two byte
+// sequences, given the checksums adler1 and adler2 of the sequences, and the
+// length of the second sequence.
+func Adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	return uint32(C.zng_adler32_combine(C.uint32_t(adler1), C.uint32_t(adler2), C.z_off_t(len2)))
+}
+
+// MakeCRC32CombineOp creates an operator that combines CRC-32 checksums, where
+// the second byte sequence is len2 bytes long.
+func MakeCRC32CombineOp(len2 int64) CRC32CombineOp {
+	var op CRC32CombineOp
+	C.zng_crc32_combine_gen((*C.uint32_t)(unsafe.Pointer(&op[0])), C.z_off_t(len2))
+	return op
+}
+
+// Combine is the same as CRC32Combine(crc1, crc2, len2), where len2 is the arg
+// passed to MakeCRC32CombineOp.
+func (op *CRC32CombineOp) Combine(crc1, crc2 uint32) uint32 {
+	return uint32(C.zng_crc32_combine_op(C.uint32_t(crc1), C.uint32_t(crc2), (*C.uint32_t)(unsafe.Pointer(&op[0]))))
+}
+
+// checksum implements hash.Hash32 on top of an update function.
+type checksum struct {
+	init      uint32 // the checksum of empty data.
+	sum       uint32 // the checksum of the data written, excluding buf.
+	blockSize int
+	update    func(sum uint32, data []byte) uint32
+	buf       []byte // data that has not been added to sum.
+}
+
+func (c *checksum) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(c.buf)+len(p) < checksumBatchSize {
+		if c.buf == nil {
+			c.buf = make([]byte, 0, checksumBatchSize)
+		}
+		c.buf = append(c.buf, p...)
+		return n, nil
+	}
+	c.flush()
+	c.sum = c.update(c.sum, p)
+	return n, nil
+}
+
+func (c *checksum) flush() {
+	if len(c.buf) > 0 {
+		c.sum = c.update(c.sum, c.buf)
+		c.buf = c.buf[:0]
+	}
+}
+
+func (c *checksum) Sum32() uint32 {
+	c.flush()
+	return c.sum
+}
+
+func (c *checksum) Sum(b []byte) []byte {
+	s := c.Sum32()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (c *checksum) Reset() {
+	c.sum = c.init
+	c.buf = c.buf[:0]
+}
+
+func (c *checksum) Size() int { return 4 }
+
+func (c *checksum) BlockSize() int { return c.blockSize }
@@ -0,0 +1,140 @@
+// +build !cgo !amd64
+
+package zlibng
+
+import (
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+)
+
+// ChecksumCRC32 returns the CRC-32 checksum of data, using the IEEE polynomial.
+// It is the same as crc32.ChecksumIEEE.
+func ChecksumCRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// ChecksumAdler32 returns the Adler-32 checksum of data. It is the same as
+// adler32.Checksum.
+func ChecksumAdler32(data []byte) uint32 {
+	return adler32.Checksum(data)
+}
+
+// NewCRC32 creates a hash.Hash32 that computes the CRC-32 checksum using the
+// IEEE polynomial. It is the same as crc32.NewIEEE.
+func NewCRC32() hash.Hash32 {
+	return crc32.NewIEEE()
+}
+
+// NewAdler32 creates a hash.Hash32 that computes the Adler-32 checksum. It is
+// the same as adler32.New.
+func NewAdler32() hash.Hash32 {
+	return adler32.New()
+}
+
+// CRC32Combine returns the CRC-32 checksum of the concatenation of two byte
+// sequences, given the checksums crc1 and crc2 of the sequences, and the length
+// of the second sequence.
+//
+// It is a port of crc32_combine from zlib 1.2.11.
+func CRC32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	var even, odd [32]uint32 // even- and odd-power-of-two zeros operators
+	odd[0] = 0xedb88320      // CRC-32 polynomial
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(even[:], odd[:]) // put operator for two zero bits in even
+	gf2MatrixSquare(odd[:], even[:]) // put operator for four zero bits in odd
+
+	// Apply len2 zeros to crc1. The first square puts the operator for one zero
+	// byte, eight zero bits, in even.
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
+
+// Adler32Combine returns the Adler-32 checksum of the concatenation of two byte
+// sequences, given the checksums adler1 and adler2 of the sequences, and the
+// length of the second sequence.
+//
+// It is a port of adler32_combine from zlib 1.2.11.
+func Adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	const base = 65521 // largest prime smaller than 65536
+	if len2 < 0 {
+		return 0xffffffff
+	}
+	rem := uint32(len2 % base)
+	sum1 := adler1 & 0xffff
+	sum2 := rem * sum1 % base
+	sum1 += (adler2 & 0xffff) + base - 1
+	sum2 += (adler1 >> 16) + (adler2 >> 16) + base - rem
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum1 >= base {
+		sum1 -= base
+	}
+	if sum2 >= base<<1 {
+		sum2 -= base << 1
+	}
+	if sum2 >= base {
+		sum2 -= base
+	}
+	return sum1 | sum2<<16
+}
+
+// MakeCRC32CombineOp creates an operator that combines CRC-32 checksums, where
+// the second byte sequence is len2 bytes long.
+func MakeCRC32CombineOp(len2 int64) CRC32CombineOp {
+	// The operator is linear, so row j is the operator applied to the j'th unit
+	// vector.
+	var op CRC32CombineOp
+	for j := range op {
+		op[j] = CRC32Combine(1<<uint(j), 0, len2)
+	}
+	return op
+}
+
+// Combine is the same as CRC32Combine(crc1, crc2, len2), where len2 is the arg
+// passed to MakeCRC32CombineOp.
+func (op *CRC32CombineOp) Combine(crc1, crc2 uint32) uint32 {
+	return gf2MatrixTimes(op[:], crc1) ^ crc2
+}
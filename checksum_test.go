@@ -0,0 +1,90 @@
+package zlibng_test
+
+import (
+	"bytes"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/yasushi-saito/zlibng"
+)
+
+func testChecksum(t *testing.T, newHash, newWant func() hash.Hash32, checksum func([]byte) uint32) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 1<<20)
+	_, _ = r.Read(data)
+
+	for _, n := range []int{0, 1, 100, 4095, 4096, 100000, len(data)} {
+		want := newWant()
+		_, _ = want.Write(data[:n])
+		assert.EQ(t, checksum(data[:n]), want.Sum32(), "n=%d", n)
+	}
+
+	// Mix small and large writes.
+	for iter := 0; iter < 10; iter++ {
+		h, want := newHash(), newWant()
+		for off := 0; off < len(data); {
+			n := r.Intn(10)
+			if r.Intn(10) == 0 {
+				n = r.Intn(20000)
+			}
+			if off+n > len(data) {
+				n = len(data) - off
+			}
+			_, _ = h.Write(data[off : off+n])
+			_, _ = want.Write(data[off : off+n])
+			off += n
+			if r.Intn(100) == 0 {
+				assert.EQ(t, h.Sum32(), want.Sum32())
+			}
+		}
+		assert.EQ(t, h.Sum32(), want.Sum32())
+		assert.EQ(t, h.Sum([]byte("x")), want.Sum([]byte("x")))
+		h.Reset()
+		assert.EQ(t, h.Sum32(), newWant().Sum32())
+	}
+}
+
+func TestCRC32(t *testing.T) {
+	testChecksum(t, zlibng.NewCRC32, func() hash.Hash32 { return crc32.NewIEEE() }, zlibng.ChecksumCRC32)
+}
+
+func TestAdler32(t *testing.T) {
+	testChecksum(t, zlibng.NewAdler32, adler32.New, zlibng.ChecksumAdler32)
+}
+
+func TestChecksumCombine(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 100000)
+	_, _ = r.Read(data)
+	for _, split := range []int{0, 1, 4096, 50000, len(data)} {
+		a, b := data[:split], data[split:]
+		assert.EQ(t,
+			zlibng.CRC32Combine(crc32.ChecksumIEEE(a), crc32.ChecksumIEEE(b), int64(len(b))),
+			crc32.ChecksumIEEE(data))
+		assert.EQ(t,
+			zlibng.Adler32Combine(adler32.Checksum(a), adler32.Checksum(b), int64(len(b))),
+			adler32.Checksum(data))
+		op := zlibng.MakeCRC32CombineOp(int64(len(b)))
+		assert.EQ(t, op.Combine(crc32.ChecksumIEEE(a), crc32.ChecksumIEEE(b)), crc32.ChecksumIEEE(data))
+	}
+}
+
+func TestParallelCRC32(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 20<<20+12345)
+	_, _ = r.Read(data)
+	for _, size := range []int{0, 1, 4 << 20, 8 << 20, len(data)} {
+		for _, workers := range []int{0, 1, 3} {
+			crc, err := zlibng.ParallelCRC32(bytes.NewReader(data), int64(size), workers)
+			assert.NoError(t, err)
+			assert.EQ(t, crc, crc32.ChecksumIEEE(data[:size]), "size=%d workers=%d", size, workers)
+		}
+	}
+	_, err := zlibng.ParallelCRC32(bytes.NewReader(data), int64(len(data)+1), 2)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+}
@@ -1,7 +1,10 @@
 package zlibng
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"time"
 )
 
@@ -22,13 +25,41 @@ const (
 // DefaultBufferSize is the default value of Opts.Buffer
 const DefaultBufferSize = 512 * 1024
 
+// DefaultMaxHeaderField is the default value of Opts.MaxHeaderField. It is large
+// enough for any gzip Extra field.
+const DefaultMaxHeaderField = 64 * 1024
+
 const (
 	// Gzip is the value of Opts.WindowBits to use FLATE format as defined in RFC1952
 	Gzip = 16 + 15
 	// Flate should is the value of Opts.WindowBits to use FLATE format as defined in RFC1951
 	Flate = -15
+	// Zlib is the value of Opts.WindowBits to use ZLIB format as defined in RFC1950
+	Zlib = 15
+)
+
+// Format specifies the format of the compressed stream. It is an alternative to
+// the WindowBits values above.
+type Format int
+
+const (
+	// FormatUnset means that Opts.WindowBits selects the format.
+	FormatUnset Format = iota
+	// FormatGzip is the gzip format defined in RFC1952.
+	FormatGzip
+	// FormatZlib is the zlib format defined in RFC1950.
+	FormatZlib
+	// FormatRaw is the raw deflate format defined in RFC1951.
+	FormatRaw
+	// FormatAuto makes the reader detect the format from the stream header. It
+	// recognizes the gzip magic number and a valid zlib header, and otherwise
+	// reads raw deflate. It cannot be used by the writer.
+	FormatAuto
 )
 
+// DefaultWindowSize is the default value of Opts.WindowSize.
+const DefaultWindowSize = 15
+
 // GzipHeader alters the contents the gzip header. It is stored in
 // Opts.GzipHeader to control the contents of the header.
 //
@@ -40,6 +71,9 @@ type GzipHeader struct {
 	Name    string
 	// OS field, cf. RFC1952 Section 2.3. Default: 255
 	OS byte
+	// Truncated is set by the reader if Comment, Extra, or Name was longer than
+	// Opts.MaxHeaderField and was cut. It is ignored by the writer.
+	Truncated bool
 }
 
 // Opts define the options passed to NewReader and NewWriter.
@@ -48,6 +82,15 @@ type Opts struct {
 	// specifies the compression window size as well as the header format.  If
 	// unset, Gzip is used.
 	WindowBits int
+	// Format specifies the stream format. If set, WindowBits must be unset, and
+	// the window size is taken from WindowSize.
+	Format Format
+	// WindowSize is the base-two logarithm of the compression window size, in
+	// [9, 15]. It can be set only with Format. The default value is
+	// DefaultWindowSize. The reader must use a window at least as large as the
+	// writer's. At level 1, zlib-ng always uses a 13-bit window. The pure-Go
+	// writer supports only 15.
+	WindowSize int
 	// Buffer specifies the internal buffer size used during compression and
 	// decompression.  The default value is 512KiB.
 	Buffer int
@@ -56,6 +99,46 @@ type Opts struct {
 	// -1 is the default compression level. If you don't pass any Opts to NewWriter,
 	// it will use -1 as the value.
 	Level int
+	// Dictionary specifies the preset dictionary. The writer passes it to
+	// deflateSetDictionary. The reader passes it to inflateSetDictionary, either
+	// at the start of a raw (Flate) stream, or when a zlib stream requests a
+	// dictionary. Dictionaries cannot be used with the Gzip format.
+	Dictionary []byte
+	// DictionaryFunc, if set, is called by the reader when a zlib stream requests
+	// a preset dictionary. id is the Adler-32 checksum of the dictionary, as
+	// recorded in the stream header. It takes precedence over Dictionary for zlib
+	// streams. It is ignored by the writer.
+	DictionaryFunc func(id uint32) ([]byte, error)
+	// Concurrency specifies the number of goroutines used by NewParallelWriter.
+	// If unset, runtime.NumCPU() is used. It is ignored by NewReader and
+	// NewWriter.
+	Concurrency int
+	// BlockSize specifies the size of the uncompressed blocks that
+	// NewParallelWriter compresses independently. It must be at least 32KiB. The
+	// default value is 128KiB. It is ignored by NewReader and NewWriter.
+	BlockSize int
+	// MaxHeaderField limits the size of each of the Comment, Extra, and Name
+	// fields of the gzip header read by the reader. Longer fields are truncated,
+	// and GzipHeader.Truncated is set. The default value is
+	// DefaultMaxHeaderField. The reader of a gzip or autodetected stream keeps
+	// a buffer for each field, which counts towards MemoryInUse. The buffers
+	// start small and grow up to this size for longer fields. It is ignored by
+	// the writer.
+	MaxHeaderField int
+	// MaxOutputBytes, MaxRatio, and MaxMembers protect the reader against
+	// decompression bombs. Once the reader crosses one of them, Read returns a
+	// *LimitError. The reader stops inflating at the limit, so it never produces
+	// much more output than allowed. Zero means no limit. They are ignored by the
+	// writer.
+	//
+	// MaxOutputBytes limits the total size of the uncompressed data.
+	MaxOutputBytes int64
+	// MaxRatio limits the size of the uncompressed data to MaxRatio times the
+	// size of the compressed data read from the input so far.
+	MaxRatio int64
+	// MaxMembers limits the number of members of a multi-member gzip or zlib
+	// file.
+	MaxMembers int
 
 	// The following fields are not for general use. They are only for NewWriter,
 	// and they are ignored by NewReader. If they are nonzero, they are passed
@@ -68,6 +151,54 @@ type Opts struct {
 	// Strategy specifies the strategy arg for deflateInit. If unset,
 	// Z_DEFAULT_STRATEGY is used.
 	Strategy int
+	// Tune, if nonzero, is passed to deflateTune after deflateInit2. Each zero
+	// field keeps the value that Level picks, so Tune adjusts Level rather than
+	// replacing it. It is ignored by NewParallelWriter, and it is not supported
+	// by the pure-Go implementation.
+	Tune Tune
+}
+
+// Tune overrides the match parameters that the compression level picks from the
+// configuration_table in deflate.c. See deflateTune in the zlib doc for details.
+// For example, Opts{Level: 4, Tune: Tune{MaxChain: 1024}} searches longer hash
+// chains than level 4 does, without switching to the slower matching of level
+// 9. Levels 0 and 1 ignore Tune.
+type Tune struct {
+	// GoodLength is the match length above which the chain search is cut to a
+	// quarter. At most 258.
+	GoodLength int
+	// MaxLazy is the match length above which levels 7 to 9 skip the lazy match
+	// search. Levels 2 to 6 use it to limit the matched strings that are added
+	// to the hash table. At most 258.
+	MaxLazy int
+	// NiceLength is the match length at which the chain search stops. At most
+	// 258.
+	NiceLength int
+	// MaxChain is the maximum number of hash chain entries searched for a match.
+	MaxChain int
+}
+
+// Stats reports the progress of a Reader or a Writer. It is returned by
+// Reader.Stats and Writer.Stats, which can be called at any point of the
+// stream, including after Close.
+type Stats struct {
+	// Compressed is the number of compressed bytes consumed by the reader, or
+	// produced by the writer.
+	Compressed int64
+	// Uncompressed is the number of uncompressed bytes produced by the reader, or
+	// consumed by the writer.
+	Uncompressed int64
+	// Members is the number of gzip or zlib members started so far, including
+	// the current one. It is at most one for the writer, and for a raw deflate
+	// stream.
+	Members int
+	// Checksum is the running CRC-32 (gzip) or Adler-32 (zlib) of the
+	// uncompressed data of the current member. At the end of a member, it is the
+	// checksum recorded in the trailer. It is zero for raw deflate streams.
+	Checksum uint32
+	// CgoTime is the time spent in the inflate or deflate calls into zlib-ng. It
+	// is zero for the pure-Go implementation.
+	CgoTime time.Duration
 }
 
 func getOpts(opts ...Opts) (Opts, error) {
@@ -82,5 +213,104 @@ func getOpts(opts ...Opts) (Opts, error) {
 	if opt.Buffer <= 0 {
 		opt.Buffer = DefaultBufferSize
 	}
+	if opt.MaxHeaderField <= 0 {
+		opt.MaxHeaderField = DefaultMaxHeaderField
+	}
+	if t := opt.Tune; t.GoodLength < 0 || t.GoodLength > 258 || t.MaxLazy < 0 || t.MaxLazy > 258 ||
+		t.NiceLength < 0 || t.NiceLength > 258 || t.MaxChain < 0 {
+		return opt, fmt.Errorf("zlibng: invalid Tune %+v", t)
+	}
+	if opt.Format == FormatUnset {
+		if opt.WindowSize != 0 {
+			return opt, errors.New("zlibng: WindowSize can be set only with Format")
+		}
+		return opt, nil
+	}
+	if opt.WindowBits != 0 {
+		return opt, errors.New("zlibng: Format and WindowBits cannot be set together")
+	}
+	if opt.WindowSize == 0 {
+		opt.WindowSize = DefaultWindowSize
+	}
+	if opt.WindowSize < 9 || opt.WindowSize > 15 {
+		return opt, fmt.Errorf("zlibng: WindowSize %d is not in [9, 15]", opt.WindowSize)
+	}
+	switch opt.Format {
+	case FormatGzip:
+		opt.WindowBits = 16 + opt.WindowSize
+	case FormatZlib:
+		opt.WindowBits = opt.WindowSize
+	case FormatRaw:
+		opt.WindowBits = -opt.WindowSize
+	case FormatAuto:
+		// The reader sets WindowBits once it sees the stream header.
+	default:
+		return opt, fmt.Errorf("zlibng: invalid Format %d", opt.Format)
+	}
 	return opt, nil
 }
+
+// outputAllowance returns the number of bytes that the reader may still produce
+// under opt.MaxOutputBytes and opt.MaxRatio, given that it has read in
+// compressed bytes and produced out uncompressed bytes. ok is false if neither
+// limit is set.
+func outputAllowance(opt Opts, in, out int64) (allowed int64, ok bool) {
+	if opt.MaxOutputBytes > 0 {
+		allowed, ok = opt.MaxOutputBytes-out, true
+	}
+	if opt.MaxRatio > 0 {
+		if r := opt.MaxRatio*in - out; !ok || r < allowed {
+			allowed, ok = r, true
+		}
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+	return allowed, ok
+}
+
+// newOutputLimitError reports that the reader produced more than the allowance
+// computed by outputAllowance. in, out, and member are recorded in the error.
+func newOutputLimitError(opt Opts, in, out int64, member int) *LimitError {
+	e := &LimitError{Limit: "MaxRatio", Value: opt.MaxRatio, In: in, Out: out, Member: member}
+	if opt.MaxOutputBytes > 0 && out >= opt.MaxOutputBytes {
+		e.Limit, e.Value = "MaxOutputBytes", opt.MaxOutputBytes
+	}
+	return e
+}
+
+// checkMaxMembers returns a *LimitError if the reader may not start member
+// number member, counting from zero.
+func checkMaxMembers(opt Opts, in, out int64, member int) error {
+	if opt.MaxMembers <= 0 || member < opt.MaxMembers {
+		return nil
+	}
+	return &LimitError{Limit: "MaxMembers", Value: int64(opt.MaxMembers), In: in, Out: out, Member: member}
+}
+
+// errAutoWriter is returned by NewWriter for FormatAuto.
+var errAutoWriter = errors.New("zlibng.NewWriter: FormatAuto can be used only by the reader")
+
+// sniffFormat reads the first two bytes of in and returns the WindowBits value
+// for the format they start. It also returns a reader that yields the whole
+// stream, including the bytes read.
+func sniffFormat(in io.Reader, windowSize int) (io.Reader, int, error) {
+	var b [2]byte
+	n, err := io.ReadFull(in, b[:])
+	if n > 0 {
+		in = io.MultiReader(bytes.NewReader(b[:n]), in)
+	}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		// Too short for any format. Let the gzip reader report the error.
+		return in, 16 + windowSize, nil
+	case err != nil:
+		return nil, 0, err
+	case b[0] == 0x1f && b[1] == 0x8b:
+		return in, 16 + windowSize, nil
+	case b[0]&0x0f == 8 && b[0]>>4 <= 7 && (uint(b[0])<<8|uint(b[1]))%31 == 0:
+		// CM is deflate, CINFO is a valid window size, and FCHECK matches.
+		return in, windowSize, nil
+	}
+	return in, -windowSize, nil
+}
@@ -0,0 +1,45 @@
+package zlibng
+
+import (
+	"context"
+	"io"
+)
+
+// contextChunkSize is the maximum number of uncompressed bytes that a reader or
+// writer created with a context processes between two checks of the context.
+const contextChunkSize = 1 << 20
+
+// CopyCompressContext compresses the data read from src and writes it to dst,
+// until src reaches EOF or ctx is done. There can be at most one options arg,
+// as in NewWriter. It returns the number of uncompressed bytes read from src.
+// On error, the stream written to dst is left unfinished, so that it can't be
+// mistaken for the complete data.
+func CopyCompressContext(ctx context.Context, dst io.Writer, src io.Reader, opts ...Opts) (int64, error) {
+	zw, err := NewWriterContext(ctx, dst, opts...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := zw.ReadFrom(src)
+	if err != nil {
+		zw.abort()
+		return n, err
+	}
+	return n, zw.Close()
+}
+
+// CopyUncompressContext uncompresses the data read from src and writes it to
+// dst, until the end of the compressed stream or until ctx is done. There can be
+// at most one options arg, as in NewReader. It returns the number of
+// uncompressed bytes written to dst.
+func CopyUncompressContext(ctx context.Context, dst io.Writer, src io.Reader, opts ...Opts) (int64, error) {
+	zr, err := NewReaderContext(ctx, src, opts...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := zr.WriteTo(dst)
+	if err != nil {
+		_ = zr.Close()
+		return n, err
+	}
+	return n, zr.Close()
+}
@@ -0,0 +1,77 @@
+package zlibng
+
+import (
+	"bytes"
+	"io"
+)
+
+// writeTo implements Reader.WriteTo. It decompresses from r into w, using *buf
+// as the output buffer. *buf is allocated with the given size if it is empty.
+//
+// If w is a *bytes.Buffer, r.Read fills the buffer's unused capacity, and *buf
+// is not used.
+func writeTo(r io.Reader, w io.Writer, buf *[]byte, size int) (int64, error) {
+	if bw, ok := w.(*bytes.Buffer); ok {
+		// bytes.Buffer.ReadFrom passes its unused capacity to r.Read, and it grows
+		// the buffer as needed. Grow first, so that the first reads are not small.
+		bw.Grow(size)
+		return bw.ReadFrom(r)
+	}
+	if len(*buf) == 0 {
+		*buf = make([]byte, size)
+	}
+	var total int64
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			nw, werr := w.Write((*buf)[:n])
+			total += int64(nw)
+			if werr != nil {
+				return total, werr
+			}
+			if nw < n {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// readFrom implements Writer.ReadFrom. It compresses the data read from r into
+// w, using *buf as the input buffer. *buf is allocated with the given size if it
+// is empty.
+//
+// If r is a *bytes.Buffer, its contents are passed to w.Write as is, and *buf
+// is not used.
+func readFrom(w io.Writer, r io.Reader, buf *[]byte, size int) (int64, error) {
+	if br, ok := r.(*bytes.Buffer); ok {
+		n, err := w.Write(br.Bytes())
+		br.Next(n)
+		return int64(n), err
+	}
+	if len(*buf) == 0 {
+		*buf = make([]byte, size)
+	}
+	var total int64
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			nw, werr := w.Write((*buf)[:n])
+			total += int64(nw)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
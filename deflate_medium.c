@@ -20,7 +20,7 @@ struct match {
     unsigned int orgstart;
 };
 
-#define MAX_DIST2  ((1 << MAX_WBITS) - MIN_LOOKAHEAD)
+#define MAX_DIST2  MAX_DIST(s)
 
 static int tr_tally_dist(deflate_state *s, int distance, int length) {
     return zng_zng_tr_tally(s, distance, length);
@@ -0,0 +1,112 @@
+package zlibng
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by zlib. They are usually wrapped in a *StreamError; use
+// errors.Is to test for them.
+var (
+	// ErrNeedDict stands for Z_NEED_DICT. The stream requires a preset
+	// dictionary, but none was given.
+	ErrNeedDict = errors.New("Zlib: need dictionary")
+	// ErrStreamError stands for Z_STREAM_ERROR.
+	ErrStreamError = errors.New("Zlib: stream error")
+	// ErrDataError stands for Z_DATA_ERROR. The input is corrupt.
+	ErrDataError = errors.New("Zlib: data error")
+	// ErrChecksum is a Z_DATA_ERROR caused by a mismatch of the checksum or the
+	// length in the gzip or zlib trailer. errors.Is(err, ErrDataError) is also
+	// true for a *StreamError that wraps ErrChecksum.
+	ErrChecksum = errors.New("Zlib: checksum error")
+	// ErrMemError stands for Z_MEM_ERROR.
+	ErrMemError = errors.New("Zlib: mem error")
+	// ErrBufError stands for Z_BUF_ERROR.
+	ErrBufError = errors.New("Zlib: buf error")
+	// ErrVersionError stands for Z_VERSION_ERROR.
+	ErrVersionError = errors.New("Zlib: version error")
+	// ErrLimitExceeded is reported when the reader crosses one of the limits in
+	// Opts, e.g., Opts.MaxOutputBytes. The error is a *LimitError.
+	ErrLimitExceeded = errors.New("zlibng: limit exceeded")
+)
+
+// StreamError describes a failure in the middle of a compressed stream.
+type StreamError struct {
+	// Err is one of the sentinel errors defined in this package, e.g.,
+	// ErrDataError, or io.ErrUnexpectedEOF if the input ended in the middle of
+	// the stream.
+	Err error
+	// Msg is the message reported by zlib, e.g., "invalid distance too far
+	// back". It may be empty.
+	Msg string
+	// In is the number of compressed bytes consumed before the failure, or -1 if
+	// unknown.
+	In int64
+	// Out is the number of uncompressed bytes produced before the failure.
+	Out int64
+	// Member is the index of the gzip member that contains the failure, starting
+	// at zero.
+	Member int
+}
+
+func (e *StreamError) Error() string {
+	msg := e.Err.Error()
+	if e.Msg != "" {
+		msg += ": " + e.Msg
+	}
+	return fmt.Sprintf("%s (member %d, in %d, out %d)", msg, e.Member, e.In, e.Out)
+}
+
+// Unwrap returns e.Err.
+func (e *StreamError) Unwrap() error { return e.Err }
+
+// Is reports whether a checksum error is being compared with ErrDataError.
+// Other comparisons are handled by Unwrap.
+func (e *StreamError) Is(target error) bool {
+	return e.Err == ErrChecksum && target == ErrDataError
+}
+
+// MemoryLimitError reports that zlib-ng could not allocate its state because
+// the limit set by SetMemoryLimit would be exceeded. errors.Is(err,
+// ErrMemError) is true for a *MemoryLimitError.
+type MemoryLimitError struct {
+	// Limit is the limit set by SetMemoryLimit.
+	Limit int64
+	// InUse is the value of MemoryInUse when the allocation failed.
+	InUse int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("zlibng: memory limit of %d bytes exceeded (%d bytes in use)", e.Limit, e.InUse)
+}
+
+// Is reports whether target is ErrMemError.
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == ErrMemError
+}
+
+// LimitError reports that the reader crossed Opts.MaxOutputBytes,
+// Opts.MaxRatio, or Opts.MaxMembers. errors.Is(err, ErrLimitExceeded) is true
+// for a *LimitError.
+type LimitError struct {
+	// Limit is the name of the option, e.g., "MaxOutputBytes".
+	Limit string
+	// Value is the value of the option.
+	Value int64
+	// In is the number of compressed bytes consumed, or -1 if unknown.
+	In int64
+	// Out is the number of uncompressed bytes returned by Read.
+	Out int64
+	// Member is the index of the gzip member being read, starting at zero.
+	Member int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("zlibng: %s limit of %d exceeded (member %d, in %d, out %d)",
+		e.Limit, e.Value, e.Member, e.In, e.Out)
+}
+
+// Is reports whether target is ErrLimitExceeded.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
@@ -0,0 +1,376 @@
+// Package httpcompress compresses HTTP responses with zlibng. NewHandler wraps
+// an http.Handler. It picks gzip or deflate from the Accept-Encoding header of
+// the request, and it compresses the response unless it is small, already
+// compressed, or of a type that doesn't compress well. The compressors are
+// pooled, and they keep their zlib-ng stream across responses, so a response
+// doesn't allocate a new one.
+package httpcompress
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yasushi-saito/zlibng"
+)
+
+// DefaultMinSize is the default value of Options.MinSize.
+const DefaultMinSize = 1024
+
+// bufferSize is the zlibng.Opts.Buffer value of the pooled writers. It is much
+// smaller than the zlibng default, since a response is usually written in small
+// pieces.
+const bufferSize = 32 * 1024
+
+// Options define the options passed to NewHandler.
+type Options struct {
+	// Level is the compression level, in [1, 9]. The default value of 0 means
+	// the default level of zlib-ng.
+	Level int
+	// MinSize is the size of the smallest response that is compressed. The
+	// handler buffers up to MinSize bytes of the response to learn its size,
+	// unless the response has a Content-Length header. A response that is
+	// flushed before reaching MinSize is compressed. The default value is
+	// DefaultMinSize.
+	MinSize int
+	// Compressible reports whether a response of the given Content-Type should be
+	// compressed. If the response has no Content-Type, it is detected by
+	// http.DetectContentType. If nil, DefaultCompressible is used.
+	Compressible func(contentType string) bool
+}
+
+// incompressibleTypes lists the media types that are already compressed, in
+// addition to the image, audio, and video types.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// DefaultCompressible returns false for the image, audio, and video types,
+// except SVG, and for the common archive and compressed font types. It returns
+// true otherwise.
+func DefaultCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return !incompressibleTypes[mediaType]
+}
+
+// handler is the http.Handler created by NewHandler.
+type handler struct {
+	h   http.Handler
+	opt Options
+	// Idle writers, keyed by the content coding.
+	gzipPool, deflatePool sync.Pool
+}
+
+// NewHandler creates an http.Handler that compresses the responses of h. There
+// can be at most one options arg. The handler adds "Vary: Accept-Encoding" to
+// every response. It doesn't compress the responses to HEAD requests, the
+// responses that have a Content-Encoding or a Content-Range header, or the ones
+// with status 204 or 304.
+//
+// The http.ResponseWriter passed to h implements http.Flusher. Flush
+// compresses the data written so far with a sync flush, and flushes the
+// underlying writer if it implements http.Flusher. Other interfaces of the
+// underlying writer are available through http.ResponseController.
+func NewHandler(h http.Handler, opts ...Options) (http.Handler, error) {
+	var opt Options
+	switch len(opts) {
+	case 0:
+	case 1:
+		opt = opts[0]
+	default:
+		return nil, errors.New("httpcompress: at most one option can be specified")
+	}
+	if opt.Level < 0 || opt.Level > 9 {
+		return nil, errors.New("httpcompress.NewHandler: invalid compression level")
+	}
+	if opt.Level == 0 {
+		opt.Level = -1
+	}
+	if opt.MinSize < 0 {
+		return nil, errors.New("httpcompress.NewHandler: negative MinSize")
+	}
+	if opt.MinSize == 0 {
+		opt.MinSize = DefaultMinSize
+	}
+	if opt.Compressible == nil {
+		opt.Compressible = DefaultCompressible
+	}
+	return &handler{h: h, opt: opt}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiate(strings.Join(r.Header["Accept-Encoding"], ","))
+	if encoding == "" || r.Method == http.MethodHead {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+	cw := &responseWriter{ResponseWriter: w, h: h, encoding: encoding, status: http.StatusOK}
+	// If h panics, the writer is returned to the pool without writing the
+	// response.
+	defer cw.release()
+	h.h.ServeHTTP(cw, r)
+	_ = cw.close()
+}
+
+// pool returns the pool of the writers for the given content coding.
+func (h *handler) pool(encoding string) *sync.Pool {
+	if encoding == "gzip" {
+		return &h.gzipPool
+	}
+	return &h.deflatePool
+}
+
+// getWriter returns a writer that compresses into w with the given content
+// coding. It returns nil on error.
+func (h *handler) getWriter(encoding string, w http.ResponseWriter) *zlibng.Writer {
+	if zw, ok := h.pool(encoding).Get().(*zlibng.Writer); ok {
+		if err := zw.Reset(w); err == nil {
+			return zw
+		}
+	}
+	format := zlibng.FormatGzip
+	if encoding == "deflate" {
+		// The deflate content coding is the zlib format (RFC 9110, section 8.4.1.2).
+		format = zlibng.FormatZlib
+	}
+	zw, err := zlibng.NewWriter(w, zlibng.Opts{Level: h.opt.Level, Format: format, Buffer: bufferSize})
+	if err != nil {
+		return nil
+	}
+	return zw
+}
+
+// negotiate picks the content coding from the Accept-Encoding header. It
+// returns "gzip", "deflate", or "" if neither is acceptable. gzip is preferred
+// when both have the same quality value.
+func negotiate(accept string) string {
+	var gzipQ, deflateQ, anyQ float64 = -1, -1, -1
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") || strings.HasPrefix(p, "Q=") {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+// responseWriter is the http.ResponseWriter passed to the wrapped handler. It
+// buffers the start of the response until it decides whether to compress it.
+type responseWriter struct {
+	http.ResponseWriter
+	h        *handler
+	encoding string // "gzip" or "deflate".
+	status   int    // status code set by WriteHeader.
+	// statusSet is true if WriteHeader or Write has been called.
+	statusSet bool
+	// decided is true once the header has been written to ResponseWriter.
+	decided bool
+	buf     []byte         // data written before the decision.
+	zw      *zlibng.Writer // non-nil if the response is compressed.
+}
+
+// WriteHeader implements http.ResponseWriter. The header is written once the
+// handler decides whether to compress the response.
+func (w *responseWriter) WriteHeader(status int) {
+	if w.decided || w.statusSet {
+		return
+	}
+	if status >= 100 && status < 200 {
+		// Informational responses can be sent any number of times.
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status, w.statusSet = status, true
+}
+
+// Write implements http.ResponseWriter.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		// As in net/http, the first Write commits the status, even if the data is
+		// buffered.
+		w.statusSet = true
+		if len(w.buf)+len(p) < w.h.opt.MinSize && w.Header().Get("Content-Length") == "" {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		if err := w.decide(true, p); err != nil {
+			return 0, err
+		}
+	}
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *responseWriter) Flush() {
+	if !w.decided {
+		if err := w.decide(true, nil); err != nil {
+			return
+		}
+	}
+	if w.zw != nil {
+		if err := w.zw.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter. It is used by
+// http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// shouldCompress reports whether the response should be compressed. large is
+// true if the response has at least MinSize bytes. sample is the start of the
+// response, used to detect the content type.
+func (w *responseWriter) shouldCompress(large bool, sample []byte) bool {
+	hdr := w.Header()
+	if hdr.Get("Content-Encoding") != "" || hdr.Get("Content-Range") != "" {
+		return false
+	}
+	switch w.status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if cl := hdr.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			large = n >= int64(w.h.opt.MinSize)
+		}
+	}
+	if !large {
+		return false
+	}
+	contentType := hdr.Get("Content-Type")
+	_, hasType := hdr["Content-Type"]
+	if !hasType {
+		// net/http would detect the type from the compressed data.
+		contentType = http.DetectContentType(sample)
+	}
+	if !w.h.opt.Compressible(contentType) {
+		return false
+	}
+	if !hasType {
+		hdr.Set("Content-Type", contentType)
+	}
+	return true
+}
+
+// decide writes the header, and the buffered data if any. next is the data
+// about to be written, used to detect the content type if nothing is buffered.
+// See shouldCompress for large.
+func (w *responseWriter) decide(large bool, next []byte) error {
+	w.decided = true
+	sample := w.buf
+	if len(sample) == 0 {
+		sample = next
+	}
+	if w.shouldCompress(large, sample) {
+		w.zw = w.h.getWriter(w.encoding, w.ResponseWriter)
+	}
+	if w.zw != nil {
+		hdr := w.Header()
+		hdr.Set("Content-Encoding", w.encoding)
+		hdr.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.zw != nil {
+		_, err = w.zw.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close completes the response after the wrapped handler returns. The writer
+// goes back to the pool in release.
+func (w *responseWriter) close() error {
+	if !w.decided {
+		if err := w.decide(false, nil); err != nil {
+			return err
+		}
+	}
+	if w.zw == nil {
+		return nil
+	}
+	return w.zw.Finish()
+}
+
+// release returns the writer, if any, to the pool, whether or not close has
+// finished the stream. The writer is reset first, so that it doesn't keep the
+// ResponseWriter.
+func (w *responseWriter) release() {
+	if w.zw == nil {
+		return
+	}
+	if err := w.zw.Reset(ioutil.Discard); err == nil {
+		w.h.pool(w.encoding).Put(w.zw)
+	}
+	w.zw = nil
+}
@@ -0,0 +1,251 @@
+package httpcompress_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/yasushi-saito/zlibng"
+	"github.com/yasushi-saito/zlibng/httpcompress"
+)
+
+var text = bytes.Repeat([]byte("hello, world. "), 1000)
+
+// serve runs handler through NewHandler for a GET request with the given
+// Accept-Encoding header.
+func serve(t *testing.T, handler http.HandlerFunc, acceptEncoding string, opts ...httpcompress.Options) *httptest.ResponseRecorder {
+	h, err := httpcompress.NewHandler(handler, opts...)
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func writeText(w http.ResponseWriter, r *http.Request) {
+	// Write in small pieces, so that the handler has to buffer them.
+	for i := 0; i < len(text); i += 100 {
+		_, _ = w.Write(text[i : i+100])
+	}
+}
+
+func uncompress(t *testing.T, rec *httptest.ResponseRecorder) []byte {
+	var (
+		r   io.Reader
+		err error
+	)
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(rec.Body)
+	case "deflate":
+		r, err = zlib.NewReader(rec.Body)
+	default:
+		return rec.Body.Bytes()
+	}
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		accept, encoding string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0.1", "deflate"},
+		{"gzip;q=0", ""},
+		{"br, identity", ""},
+		{"*", "gzip"},
+		{"*;q=0.5, gzip;q=0", "deflate"},
+	} {
+		rec := serve(t, writeText, test.accept)
+		assert.EQ(t, rec.Code, http.StatusOK)
+		assert.EQ(t, rec.Header().Get("Content-Encoding"), test.encoding, "accept=%q", test.accept)
+		assert.EQ(t, rec.Header().Get("Vary"), "Accept-Encoding")
+		assert.EQ(t, rec.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+		assert.True(t, bytes.Equal(uncompress(t, rec), text))
+		if test.encoding != "" {
+			assert.True(t, rec.Body.Len() < len(text)/10, "len=%d", rec.Body.Len())
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		opts     []httpcompress.Options
+		encoding string // Content-Encoding of the response.
+		body     []byte
+	}{
+		{"small", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(text[:100])
+		}, nil, "", text[:100]},
+		{"small content length", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write(text[:100])
+		}, nil, "", text[:100]},
+		{"min size", writeText, []httpcompress.Options{{MinSize: len(text) + 1}}, "", text},
+		{"image", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			writeText(w, r)
+		}, nil, "", text},
+		{"compressible", writeText, []httpcompress.Options{{Compressible: func(string) bool { return false }}}, "", text},
+		{"encoded", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "identity")
+			writeText(w, r)
+		}, nil, "identity", text},
+		{"partial", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-13999/20000")
+			w.WriteHeader(http.StatusPartialContent)
+			writeText(w, r)
+		}, nil, "", text},
+	} {
+		rec := serve(t, test.handler, "gzip", test.opts...)
+		assert.EQ(t, rec.Header().Get("Content-Encoding"), test.encoding, test.name)
+		assert.EQ(t, rec.Header().Get("Vary"), "Accept-Encoding", test.name)
+		assert.True(t, bytes.Equal(rec.Body.Bytes(), test.body), test.name)
+	}
+
+	rec := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}, "gzip")
+	assert.EQ(t, rec.Code, http.StatusNotModified)
+	assert.EQ(t, rec.Header().Get("Content-Encoding"), "")
+}
+
+func TestWriteHeaderAfterWrite(t *testing.T) {
+	// "hi" is buffered, but net/http would have sent 200 already.
+	rec := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hi"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}, "gzip")
+	assert.EQ(t, rec.Code, http.StatusOK)
+	assert.EQ(t, rec.Body.String(), "hi")
+}
+
+func TestContentLength(t *testing.T) {
+	rec := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+		w.WriteHeader(http.StatusCreated)
+		writeText(w, r)
+	}, "gzip")
+	assert.EQ(t, rec.Code, http.StatusCreated)
+	assert.EQ(t, rec.Header().Get("Content-Encoding"), "gzip")
+	assert.EQ(t, rec.Header().Get("Content-Length"), "")
+	assert.EQ(t, rec.Header().Get("Content-Type"), "application/json")
+	assert.True(t, bytes.Equal(uncompress(t, rec), text))
+}
+
+func TestFlush(t *testing.T) {
+	var rec *httptest.ResponseRecorder
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		assert.True(t, rec.Flushed)
+		// The data before the flush can be decompressed before the end of the
+		// response.
+		zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		assert.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(zr, buf)
+		assert.NoError(t, err)
+		assert.EQ(t, string(buf), "hello")
+		_, _ = w.Write([]byte(", world"))
+	}
+	h, err := httpcompress.NewHandler(http.HandlerFunc(handler))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.EQ(t, rec.Header().Get("Content-Encoding"), "gzip")
+	assert.EQ(t, string(uncompress(t, rec)), "hello, world")
+}
+
+func TestHead(t *testing.T) {
+	h, err := httpcompress.NewHandler(http.HandlerFunc(writeText))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("HEAD", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.EQ(t, rec.Header().Get("Content-Encoding"), "")
+	assert.EQ(t, rec.Header().Get("Vary"), "Accept-Encoding")
+}
+
+func TestServer(t *testing.T) {
+	h, err := httpcompress.NewHandler(http.HandlerFunc(writeText), httpcompress.Options{Level: 9})
+	assert.NoError(t, err)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	// The http client asks for gzip and decompresses the response. The later
+	// requests reuse the pooled writer.
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.True(t, resp.Uncompressed)
+		assert.True(t, bytes.Equal(data, text))
+	}
+}
+
+func TestPooledWriter(t *testing.T) {
+	h, err := httpcompress.NewHandler(http.HandlerFunc(writeText))
+	assert.NoError(t, err)
+	serve := func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.EQ(t, rec.Header().Get("Content-Encoding"), "gzip")
+		assert.True(t, bytes.Equal(uncompress(t, rec), text))
+	}
+	serve()
+	// The pooled writer keeps its zlib-ng stream, so the later responses are
+	// compressed without allocating a new one.
+	old := zlibng.SetMemoryLimit(zlibng.MemoryInUse() + 1)
+	defer zlibng.SetMemoryLimit(old)
+	for i := 0; i < 3; i++ {
+		serve()
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := httpcompress.NewHandler(http.HandlerFunc(writeText), httpcompress.Options{Level: 10})
+	assert.Regexp(t, err, "invalid compression level")
+	_, err = httpcompress.NewHandler(http.HandlerFunc(writeText), httpcompress.Options{MinSize: -1})
+	assert.Regexp(t, err, "negative MinSize")
+	_, err = httpcompress.NewHandler(http.HandlerFunc(writeText), httpcompress.Options{}, httpcompress.Options{})
+	assert.Regexp(t, err, "at most one option")
+}
+
+func TestDefaultCompressible(t *testing.T) {
+	assert.True(t, httpcompress.DefaultCompressible("text/html; charset=utf-8"))
+	assert.True(t, httpcompress.DefaultCompressible("application/json"))
+	assert.True(t, httpcompress.DefaultCompressible("image/svg+xml"))
+	assert.True(t, httpcompress.DefaultCompressible(""))
+	assert.False(t, httpcompress.DefaultCompressible("image/jpeg"))
+	assert.False(t, httpcompress.DefaultCompressible("video/mp4"))
+	assert.False(t, httpcompress.DefaultCompressible("application/gzip"))
+	assert.False(t, httpcompress.DefaultCompressible("font/woff2"))
+}
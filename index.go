@@ -0,0 +1,228 @@
+package zlibng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Index is a random-access index of a gzip or zlib file, in the style of zran.c
+// in the zlib distribution. It records access points at deflate block
+// boundaries, roughly every Span uncompressed bytes. Each access point stores
+// the 32KiB of uncompressed data that precede it, so the index is about
+// 32KiB*Size/Span bytes.
+//
+// An Index is created by BuildIndex or ReadIndex, and it is used by
+// NewReaderAt.
+type Index struct {
+	// Span is the minimum distance between access points, in uncompressed bytes.
+	Span int64
+	// Size is the size of the uncompressed data.
+	Size int64
+
+	points []indexPoint
+}
+
+// indexPoint is an access point in Index.
+type indexPoint struct {
+	out    int64  // offset in the uncompressed data.
+	in     int64  // offset of the first full byte in the compressed data.
+	bits   int    // number of bits (1-7) taken from the byte at in-1, or 0.
+	window []byte // up to 32KiB of uncompressed data that precede out.
+}
+
+// NumPoints returns the number of access points in the index.
+func (idx *Index) NumPoints() int { return len(idx.points) }
+
+// findPoint returns the last access point at or before the uncompressed offset
+// off.
+func (idx *Index) findPoint(off int64) *indexPoint {
+	i := sort.Search(len(idx.points), func(i int) bool { return idx.points[i].out > off })
+	if i == 0 {
+		return nil
+	}
+	return &idx.points[i-1]
+}
+
+const (
+	indexMagic   = "ZNGINDEX"
+	indexVersion = 1
+)
+
+// WriteTo serializes the index. The format is stable across versions of this
+// package. All integers are little endian.
+//
+//	magic   [8]byte  "ZNGINDEX"
+//	version uint32   1
+//	span    int64
+//	size    int64
+//	npoints uint64
+//	npoints times:
+//	  out    int64
+//	  in     int64
+//	  bits   uint8
+//	  wsize  uint32
+//	  window [wsize]byte
+//	crc     uint32   CRC-32 (IEEE) of all the preceding bytes
+//
+// It implements io.WriterTo.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	var (
+		crc = crc32.NewIEEE()
+		bw  = bufio.NewWriter(io.MultiWriter(w, crc))
+		cw  = &countingWriter{w: bw}
+		buf [8]byte
+	)
+	// Errors are recorded in cw.err.
+	write := func(b []byte) { _, _ = cw.Write(b) }
+	put32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf[:4], v)
+		write(buf[:4])
+	}
+	put64 := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		write(buf[:])
+	}
+	write([]byte(indexMagic))
+	put32(indexVersion)
+	put64(uint64(idx.Span))
+	put64(uint64(idx.Size))
+	put64(uint64(len(idx.points)))
+	for _, pt := range idx.points {
+		put64(uint64(pt.out))
+		put64(uint64(pt.in))
+		write([]byte{byte(pt.bits)})
+		put32(uint32(len(pt.window)))
+		write(pt.window)
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	binary.LittleEndian.PutUint32(buf[:4], crc.Sum32())
+	n, err := w.Write(buf[:4])
+	return cw.n + int64(n), err
+}
+
+// ReadIndex reads an index serialized by Index.WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	var (
+		crc = crc32.NewIEEE()
+		br  = io.TeeReader(bufio.NewReader(r), crc)
+		buf [8]byte
+		err error
+	)
+	read := func(b []byte) {
+		if err == nil {
+			if _, err = io.ReadFull(br, b); err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+	}
+	get32 := func() uint32 {
+		read(buf[:4])
+		return binary.LittleEndian.Uint32(buf[:4])
+	}
+	get64 := func() uint64 {
+		read(buf[:])
+		return binary.LittleEndian.Uint64(buf[:])
+	}
+	read(buf[:])
+	if err == nil && string(buf[:]) != indexMagic {
+		return nil, errors.New("zlibng.ReadIndex: not an index")
+	}
+	if version := get32(); err == nil && version != indexVersion {
+		return nil, fmt.Errorf("zlibng.ReadIndex: unsupported version %d", version)
+	}
+	idx := &Index{}
+	idx.Span = int64(get64())
+	idx.Size = int64(get64())
+	n := get64()
+	for i := uint64(0); i < n && err == nil; i++ {
+		pt := indexPoint{}
+		pt.out = int64(get64())
+		pt.in = int64(get64())
+		read(buf[:1])
+		pt.bits = int(buf[0])
+		wsize := get32()
+		if err == nil && (wsize > maxDictSize || pt.bits > 7) {
+			return nil, errors.New("zlibng.ReadIndex: corrupt index")
+		}
+		pt.window = make([]byte, wsize)
+		read(pt.window)
+		idx.points = append(idx.points, pt)
+	}
+	want := crc.Sum32()
+	if got := get32(); err == nil && got != want {
+		return nil, errors.New("zlibng.ReadIndex: checksum mismatch")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+// ReaderAt provides random access to the uncompressed contents of a gzip or
+// zlib file, using an Index. It implements io.ReaderAt, and it is safe for
+// concurrent use.
+type ReaderAt struct {
+	ra  io.ReaderAt
+	idx *Index
+}
+
+// NewReaderAt creates a ReaderAt for the compressed file ra. idx must have been
+// built from the same file.
+func NewReaderAt(ra io.ReaderAt, idx *Index) (*ReaderAt, error) {
+	if len(idx.points) == 0 {
+		return nil, errors.New("zlibng.NewReaderAt: empty index")
+	}
+	return &ReaderAt{ra: ra, idx: idx}, nil
+}
+
+// Size returns the size of the uncompressed data.
+func (r *ReaderAt) Size() int64 { return r.idx.Size }
+
+// ReadAt implements io.ReaderAt. It decompresses the data starting at the
+// access point that precedes off.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zlibng.ReadAt: negative offset")
+	}
+	if off >= r.idx.Size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	pt := r.idx.findPoint(off)
+	if pt == nil {
+		return 0, errors.New("zlibng.ReadAt: corrupt index")
+	}
+	n, err := inflateAt(r.ra, pt, off-pt.out, p)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
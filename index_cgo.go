@@ -0,0 +1,194 @@
+// +build cgo,amd64
+
+package zlibng
+
+/*
+#include "./zlib-ng.h"
+#include "./zstream.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"io"
+	"unsafe"
+)
+
+// BuildIndex reads a gzip or zlib file and creates an index with access points
+// roughly every span uncompressed bytes. Only single-member gzip files are
+// supported.
+func BuildIndex(r io.Reader, span int64) (*Index, error) {
+	if span <= 0 {
+		return nil, errors.New("zlibng.BuildIndex: span must be positive")
+	}
+	var (
+		zs              zstream
+		getHeaderStatus C.int
+		idx             = &Index{Span: span}
+		inBuf           = make([]byte, 64*1024)
+		inConsumed      = true
+		inEOF           = false
+		// window is a circular buffer that holds the last maxDictSize bytes of the
+		// uncompressed data. The next byte is stored at window[pos].
+		window = make([]byte, maxDictSize)
+		pos    = 0
+		last   = int64(0) // offset of the last access point
+	)
+	if ec := C.zs_inflate_init(&zs[0], 32+15, nil, &getHeaderStatus); ec != 0 {
+		return nil, streamReturnCodeToError(&zs, ec)
+	}
+	defer C.zs_inflate_end(&zs[0])
+	for {
+		var (
+			outLen      = C.int(len(window) - pos)
+			inConsumed2 C.int
+			dataType    C.int
+			ret         C.int
+		)
+		if !inConsumed {
+			ret = C.zs_inflate_block(&zs[0], nil, 0, unsafe.Pointer(&window[pos]), &outLen, &inConsumed2, &dataType)
+		} else {
+			if inEOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			n, err := io.ReadFull(r, inBuf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				inEOF = true
+			} else if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			ret = C.zs_inflate_block(&zs[0], unsafe.Pointer(&inBuf[0]), C.int(n), unsafe.Pointer(&window[pos]), &outLen, &inConsumed2, &dataType)
+		}
+		inConsumed = (inConsumed2 != 0)
+		if ret == C.Z_NEED_DICT {
+			return nil, errors.New("zlibng.BuildIndex: streams with a preset dictionary are not supported")
+		}
+		if ret != C.Z_OK && ret != C.Z_STREAM_END {
+			return nil, zlibReturnCodeToError(ret)
+		}
+		pos = len(window) - int(outLen)
+		if pos == len(window) {
+			pos = 0
+		}
+		if ret == C.Z_STREAM_END {
+			idx.Size = int64(C.zs_get_total_out(&zs[0]))
+			break
+		}
+		// Bit 7 of data_type is set at the end of a deflate block header, and bit 6
+		// is set if the block is the last one. See zran.c.
+		out := int64(C.zs_get_total_out(&zs[0]))
+		if dataType&128 != 0 && dataType&64 == 0 && (out == 0 || out-last >= span) {
+			pt := indexPoint{
+				out:  out,
+				in:   int64(C.zs_get_total_in(&zs[0])),
+				bits: int(dataType & 7),
+			}
+			if out >= int64(len(window)) {
+				pt.window = make([]byte, 0, len(window))
+				pt.window = append(pt.window, window[pos:]...)
+			}
+			pt.window = append(pt.window, window[:pos]...)
+			idx.points = append(idx.points, pt)
+			last = out
+		}
+	}
+	// Reject trailing data, such as another gzip member.
+	if !inConsumed {
+		return nil, errors.New("zlibng.BuildIndex: multi-member files are not supported")
+	}
+	if !inEOF {
+		var buf [1]byte
+		if n, _ := io.ReadFull(r, buf[:]); n > 0 {
+			return nil, errors.New("zlibng.BuildIndex: multi-member files are not supported")
+		}
+	}
+	if len(idx.points) == 0 {
+		// The stream has no data. Add a point at the start, so that NewReaderAt
+		// accepts the index.
+		idx.points = append(idx.points, indexPoint{})
+	}
+	return idx, nil
+}
+
+// inflateAt decompresses the data starting at skip bytes after the access point
+// into p. It returns the number of bytes filled. A short count means the end of
+// the deflate stream.
+func inflateAt(ra io.ReaderAt, pt *indexPoint, skip int64, p []byte) (int, error) {
+	var (
+		zs              zstream
+		getHeaderStatus C.int
+	)
+	if ec := C.zs_inflate_init(&zs[0], C.int(Flate), nil, &getHeaderStatus); ec != 0 {
+		return 0, streamReturnCodeToError(&zs, ec)
+	}
+	defer C.zs_inflate_end(&zs[0])
+	in := pt.in
+	if pt.bits > 0 {
+		var b [1]byte
+		if _, err := ra.ReadAt(b[:], in-1); err != nil {
+			return 0, err
+		}
+		if ec := C.zs_inflate_prime(&zs[0], C.int(pt.bits), C.int(b[0]>>uint(8-pt.bits))); ec != 0 {
+			return 0, zlibReturnCodeToError(ec)
+		}
+	}
+	if len(pt.window) > 0 {
+		if ec := C.zs_inflate_set_dictionary(&zs[0], unsafe.Pointer(&pt.window[0]), C.int(len(pt.window))); ec != 0 {
+			return 0, zlibReturnCodeToError(ec)
+		}
+	}
+	var (
+		inBuf      = make([]byte, 64*1024)
+		discard    []byte
+		inConsumed = true
+		n          = 0
+	)
+	if skip > 0 {
+		discard = make([]byte, 64*1024)
+	}
+	for n < len(p) {
+		// Decompress into discard until skip bytes are skipped, then into p.
+		out := p[n:]
+		if skip > 0 {
+			out = discard
+			if int64(len(out)) > skip {
+				out = out[:skip]
+			}
+		}
+		var (
+			outLen      = C.int(len(out))
+			inConsumed2 C.int
+			ret         C.int
+		)
+		if !inConsumed {
+			ret = C.zs_inflate(&zs[0], nil, 0, unsafe.Pointer(&out[0]), &outLen, &inConsumed2)
+		} else {
+			nIn, err := ra.ReadAt(inBuf, in)
+			if nIn == 0 {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			in += int64(nIn)
+			ret = C.zs_inflate(&zs[0], unsafe.Pointer(&inBuf[0]), C.int(nIn), unsafe.Pointer(&out[0]), &outLen, &inConsumed2)
+		}
+		inConsumed = (inConsumed2 != 0)
+		if ret != C.Z_OK && ret != C.Z_STREAM_END {
+			return n, zlibReturnCodeToError(ret)
+		}
+		nOut := len(out) - int(outLen)
+		if skip > 0 {
+			skip -= int64(nOut)
+		} else {
+			n += nOut
+		}
+		if ret == C.Z_STREAM_END {
+			break
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,17 @@
+// +build !cgo !amd64
+
+package zlibng
+
+import (
+	"errors"
+	"io"
+)
+
+// BuildIndex is not supported by the pure-Go implementation.
+func BuildIndex(r io.Reader, span int64) (*Index, error) {
+	return nil, errors.New("zlibng.BuildIndex: Not supported")
+}
+
+func inflateAt(ra io.ReaderAt, pt *indexPoint, skip int64, p []byte) (int, error) {
+	return 0, errors.New("zlibng.ReadAt: Not supported")
+}
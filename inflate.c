@@ -515,7 +515,8 @@ int ZEXPORT PREFIX(inflate)(PREFIX3(stream) *strm, int flush) {
                     copy = have;
                 if (copy) {
                     if (state->head != NULL &&
-                        state->head->extra != NULL) {
+                        state->head->extra != NULL &&
+                        state->head->extra_len - state->length < state->head->extra_max) {
                         len = state->head->extra_len - state->length;
                         memcpy(state->head->extra + len, next,
                                 len + copy > state->head->extra_max ?
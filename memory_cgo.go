@@ -0,0 +1,44 @@
+// +build cgo,amd64
+
+package zlibng
+
+/*
+#include "./zstream.h"
+*/
+import "C"
+
+// MemoryInUse returns the number of bytes that zlib-ng has allocated for the
+// state of the live readers and writers. The memory is allocated by C, so it is
+// not visible to the Go runtime.
+func MemoryInUse() int64 {
+	return int64(C.zs_get_total_mem_in_use())
+}
+
+// SetMemoryLimit limits MemoryInUse to limit bytes. Once the limit is reached,
+// creating or resetting a reader or writer fails with a *MemoryLimitError. A
+// limit of zero or less removes the limit. It returns the previous limit.
+//
+// The limit applies to new allocations only. Streams that already hold their
+// state are not affected.
+func SetMemoryLimit(limit int64) int64 {
+	if limit < 0 {
+		limit = 0
+	}
+	return int64(C.zs_set_mem_limit(C.longlong(limit)))
+}
+
+func memoryLimit() int64 {
+	return int64(C.zs_get_mem_limit())
+}
+
+// MemoryInUse returns the number of bytes that zlib-ng has allocated for the
+// reader. It is zero after Close.
+func (z *Reader) MemoryInUse() int64 {
+	return int64(C.zs_get_mem_in_use(&z.zs[0]))
+}
+
+// MemoryInUse returns the number of bytes that zlib-ng has allocated for the
+// writer. It is zero after Close, but not after Finish.
+func (z *Writer) MemoryInUse() int64 {
+	return int64(C.zs_get_mem_in_use(&z.zs[0]))
+}
@@ -0,0 +1,32 @@
+// +build !cgo !amd64
+
+package zlibng
+
+import "sync/atomic"
+
+var memLimit int64
+
+// MemoryInUse always returns zero. The pure-Go implementation allocates its
+// state in the Go heap, which the Go runtime accounts for.
+func MemoryInUse() int64 {
+	return 0
+}
+
+// SetMemoryLimit records the limit and returns the previous one. The limit
+// has no effect on the pure-Go implementation.
+func SetMemoryLimit(limit int64) int64 {
+	if limit < 0 {
+		limit = 0
+	}
+	return atomic.SwapInt64(&memLimit, limit)
+}
+
+// MemoryInUse always returns zero. See the package-level MemoryInUse.
+func (r *Reader) MemoryInUse() int64 {
+	return 0
+}
+
+// MemoryInUse always returns zero. See the package-level MemoryInUse.
+func (w *Writer) MemoryInUse() int64 {
+	return 0
+}
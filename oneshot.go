@@ -0,0 +1,50 @@
+package zlibng
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// maxDeflateRatio is the largest possible ratio of the uncompressed size to the
+// compressed size of a deflate stream.
+const maxDeflateRatio = 1032
+
+func checkCompressArgs(level, format int) error {
+	if level < -1 || level > 9 {
+		return errors.New("zlibng.Compress: invalid compression level")
+	}
+	if format != Gzip && format != Zlib && format != Flate {
+		return errors.New("zlibng.Compress: format must be one of Gzip, Zlib, or Flate")
+	}
+	return nil
+}
+
+// detectFormat guesses the format of the compressed data. It returns Gzip or
+// Zlib if src starts with a valid header of the format. Otherwise it returns
+// Flate.
+func detectFormat(src []byte) int {
+	if len(src) < 2 {
+		return Flate
+	}
+	if src[0] == 0x1f && src[1] == 0x8b {
+		return Gzip
+	}
+	// RFC1950 section 2.2: CM=8, CINFO<=7, and FCHECK makes the header a
+	// multiple of 31.
+	if src[0]&0x0f == 8 && src[0]>>4 <= 7 && (uint(src[0])<<8|uint(src[1]))%31 == 0 {
+		return Zlib
+	}
+	return Flate
+}
+
+// uncompressedSizeHint guesses the size of the data that src uncompresses to.
+func uncompressedSizeHint(src []byte, format int) int {
+	if format == Gzip && len(src) >= 18 {
+		// ISIZE in the trailer. It is correct if the file has only one member and
+		// is smaller than 4GiB.
+		if n := int(binary.LittleEndian.Uint32(src[len(src)-4:])); n <= maxDeflateRatio*len(src) {
+			return n
+		}
+	}
+	return 4*len(src) + 64
+}
@@ -0,0 +1,111 @@
+// +build cgo,amd64
+
+package zlibng
+
+/*
+#include "./zlib-ng.h"
+#include "./zstream.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// CompressBound returns the maximum size of the data produced by Compress for
+// an input of n bytes, in any format.
+func CompressBound(n int) int {
+	// zng_compressBound is too small for level 1. deflate_quick always uses the
+	// static Huffman codes, which take up to 9 bits per literal. This is the
+	// conservative bound of deflateBound, which covers them, plus the 18 bytes of
+	// the gzip header and trailer.
+	const gzipOverhead = 18
+	return n + (n+7)>>3 + (n+63)>>6 + 5 + gzipOverhead
+}
+
+// Compress compresses src in one shot. level is the compression level, -1 to 9.
+// format is one of Gzip, Zlib, or Flate. The result is stored in dst if its
+// capacity is at least CompressBound(len(src)). Otherwise a new slice is
+// allocated.
+func Compress(dst, src []byte, level, format int) ([]byte, error) {
+	if err := checkCompressArgs(level, format); err != nil {
+		return nil, err
+	}
+	if n := CompressBound(len(src)); cap(dst) < n {
+		dst = make([]byte, n)
+	}
+	dst = dst[:cap(dst)]
+	var in unsafe.Pointer
+	if len(src) > 0 {
+		in = unsafe.Pointer(&src[0])
+	}
+	outLen := C.size_t(len(dst))
+	if ec := C.zs_compress(C.int(level), C.int(format), in, C.size_t(len(src)), unsafe.Pointer(&dst[0]), &outLen); ec != 0 {
+		return nil, zlibReturnCodeToError(ec)
+	}
+	return dst[:outLen], nil
+}
+
+// Uncompress uncompresses src in one shot. The format (gzip, zlib, or raw
+// flate) is detected from the header. A gzip file may contain multiple members.
+// The result is stored in dst if it has enough capacity. Otherwise a new slice
+// is allocated.
+func Uncompress(dst, src []byte) ([]byte, error) {
+	var (
+		zs              zstream
+		getHeaderStatus C.int
+		format          = detectFormat(src)
+		member          int
+		inBase, outBase int64 // the sizes of the preceding members.
+	)
+	if ec := C.zs_inflate_init(&zs[0], C.int(format), nil, &getHeaderStatus); ec != 0 {
+		return nil, streamReturnCodeToError(&zs, ec)
+	}
+	defer C.zs_inflate_end(&zs[0])
+	dst = dst[:0]
+	if cap(dst) == 0 {
+		dst = make([]byte, 0, uncompressedSizeHint(src, format))
+	}
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		var (
+			out    = dst[len(dst):cap(dst)]
+			inLen  = C.size_t(len(src))
+			outLen = C.size_t(len(out))
+			in     unsafe.Pointer
+		)
+		if len(src) > 0 {
+			in = unsafe.Pointer(&src[0])
+		}
+		ret := C.zs_inflate_buf(&zs[0], in, &inLen, unsafe.Pointer(&out[0]), &outLen)
+		src = src[len(src)-int(inLen):]
+		dst = dst[:cap(dst)-int(outLen)]
+		switch ret {
+		case C.Z_OK:
+		case C.Z_STREAM_END:
+			if len(src) == 0 {
+				return dst, nil
+			}
+			if format != Gzip {
+				return nil, errors.New("zlibng.Uncompress: trailing data after the end of the stream")
+			}
+			member++
+			inBase += int64(C.zs_get_total_in(&zs[0]))
+			outBase += int64(C.zs_get_total_out(&zs[0]))
+			if ec := C.zs_inflate_reset(&zs[0], nil, &getHeaderStatus); ec != 0 {
+				return nil, zlibReturnCodeToError(ec)
+			}
+		case C.Z_BUF_ERROR:
+			// No progress was possible. It is fine if the output is full; it will be
+			// grown at the next iteration.
+			if outLen > 0 {
+				return nil, newTruncatedError(&zs, inBase, outBase, member)
+			}
+		default:
+			return nil, newStreamError(&zs, ret, inBase, outBase, member)
+		}
+	}
+}
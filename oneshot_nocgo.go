@@ -0,0 +1,102 @@
+// +build !cgo !amd64
+
+package zlibng
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+)
+
+// CompressBound returns the maximum size of the data produced by Compress for
+// an input of n bytes, in any format.
+func CompressBound(n int) int {
+	// Same as zng_compressBound, plus the extra 12 bytes of the gzip header and
+	// trailer, plus 5 bytes for the empty block that klauspost/compress may add
+	// at the end.
+	return n + (n >> 12) + (n >> 14) + (n >> 25) + 13 + 12 + 5
+}
+
+// Compress compresses src in one shot. level is the compression level, -1 to 9.
+// format is one of Gzip, Zlib, or Flate. The result is stored in dst if it has
+// enough capacity. Otherwise a new slice is allocated.
+func Compress(dst, src []byte, level, format int) ([]byte, error) {
+	if err := checkCompressArgs(level, format); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst[:0])
+	var (
+		w   io.WriteCloser
+		err error
+	)
+	switch format {
+	case Gzip:
+		w, err = gzip.NewWriterLevel(buf, level)
+	case Zlib:
+		w, err = zlib.NewWriterLevel(buf, level)
+	default:
+		w, err = flate.NewWriter(buf, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Uncompress uncompresses src in one shot. The format (gzip, zlib, or raw
+// flate) is detected from the header. A gzip file may contain multiple members.
+// The result is stored in dst if it has enough capacity. Otherwise a new slice
+// is allocated.
+func Uncompress(dst, src []byte) ([]byte, error) {
+	var (
+		in     = bytes.NewReader(src)
+		format = detectFormat(src)
+		r      io.ReadCloser
+		err    error
+	)
+	switch format {
+	case Gzip:
+		r, err = gzip.NewReader(in)
+	case Zlib:
+		r, err = zlib.NewReader(in)
+	default:
+		r = flate.NewReader(in)
+	}
+	if err != nil {
+		return nil, convertError(noEOF(err), 0, 0)
+	}
+	if cap(dst) == 0 {
+		dst = make([]byte, 0, uncompressedSizeHint(src, format))
+	}
+	dst = dst[:0]
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, convertError(err, int64(len(dst)), 0)
+		}
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	if format != Gzip && in.Len() != 0 {
+		return nil, errors.New("zlibng.Uncompress: trailing data after the end of the stream")
+	}
+	return dst, nil
+}
@@ -0,0 +1,305 @@
+package zlibng
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBlockSize is the default value of Opts.BlockSize.
+	DefaultBlockSize = 128 * 1024
+	// maxDictSize is the size of the deflate window. Each block of a
+	// ParallelWriter is compressed using the last maxDictSize bytes of the
+	// previous block as the dictionary.
+	maxDictSize = 32 * 1024
+)
+
+// errParallelWriterClosed is returned by the methods of a closed
+// ParallelWriter.
+var errParallelWriterClosed = errors.New("zlibng.ParallelWriter: writer is closed")
+
+// parallelBlock is a unit of compression in ParallelWriter.
+type parallelBlock struct {
+	in   []byte // uncompressed data.
+	dict []byte // the last maxDictSize bytes of the previous block.
+	last bool   // true if this is the last block of the stream.
+
+	// Filled by the worker.
+	out  []byte // compressed data.
+	crc  uint32 // CRC-32 of in.
+	err  error
+	done chan struct{}
+}
+
+// ParallelWriter is a gzip writer that compresses the data on multiple
+// goroutines, in the style of pigz. The input is split into blocks of
+// Opts.BlockSize bytes, and each block is compressed using the last 32KiB of the
+// previous block as the dictionary. The compressed blocks are joined at sync
+// flush boundaries, so the output is a single standard gzip member. The output
+// depends only on the data and the options; it is the same regardless of
+// Opts.Concurrency. It implements io.WriteCloser.
+//
+// The compression ratio is slightly worse than that of Writer, because of the
+// sync flush markers and the dictionary resets at block boundaries.
+type ParallelWriter struct {
+	out           io.Writer
+	opt           Opts
+	header        GzipHeader
+	headerWritten bool
+
+	block   *parallelBlock   // block being filled by Write.
+	dict    []byte           // the last maxDictSize bytes of the last submitted block.
+	pending []*parallelBlock // blocks submitted to the workers, in stream order.
+	free    []*parallelBlock // blocks that can be reused.
+
+	work     chan *parallelBlock
+	nWorkers int
+	wg       sync.WaitGroup
+
+	crc    uint32 // CRC-32 of the data written to out so far.
+	size   int64  // size of the uncompressed data written to out so far.
+	closed bool
+	err    error
+}
+
+// NewParallelWriter creates a parallel gzip writer. There can be at most one
+// options arg. Opts.WindowBits, if set, must be Gzip. Opts.Concurrency and
+// Opts.BlockSize control the parallelism. Opts.Buffer is unused.
+func NewParallelWriter(w io.Writer, opts ...Opts) (*ParallelWriter, error) {
+	opt, err := getOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if opt.WindowBits != 0 && opt.WindowBits != Gzip {
+		return nil, errors.New("zlibng.NewParallelWriter: only the Gzip format is supported")
+	}
+	if len(opt.Dictionary) > 0 {
+		return nil, errors.New("zlibng.NewParallelWriter: Dictionary cannot be used with the Gzip format")
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = runtime.NumCPU()
+	}
+	if opt.BlockSize == 0 {
+		opt.BlockSize = DefaultBlockSize
+	}
+	if opt.BlockSize < maxDictSize {
+		return nil, errors.New("zlibng.NewParallelWriter: BlockSize must be at least 32KiB")
+	}
+	if opt.MemLevel == 0 {
+		opt.MemLevel = 8
+	}
+	return &ParallelWriter{
+		out:  w,
+		opt:  opt,
+		work: make(chan *parallelBlock, opt.Concurrency),
+	}, nil
+}
+
+// SetHeader sets the gzip header contents.
+//
+// REQUIRES: No Write nor Close has been called yet.
+func (z *ParallelWriter) SetHeader(h GzipHeader) error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.headerWritten || z.block != nil || len(z.pending) > 0 {
+		return errors.New("zlibng.SetHeader: header must be set before Write")
+	}
+	if len(h.Extra) > 0xffff {
+		return errors.New("zlibng.SetHeader: Extra is longer than 65535 bytes")
+	}
+	z.header = h
+	return nil
+}
+
+// Write implements io.Writer.
+func (z *ParallelWriter) Write(in []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(in)
+	for len(in) > 0 {
+		if z.block == nil {
+			z.block = z.newBlock()
+		}
+		m := z.opt.BlockSize - len(z.block.in)
+		if m > len(in) {
+			m = len(in)
+		}
+		z.block.in = append(z.block.in, in[:m]...)
+		in = in[m:]
+		if len(z.block.in) == z.opt.BlockSize {
+			if err := z.submit(false); err != nil {
+				return n - len(in), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the remaining data and the gzip trailer, and stops the worker
+// goroutines. It does not close the underlying writer.
+func (z *ParallelWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	if z.err == nil {
+		if z.block == nil {
+			z.block = z.newBlock()
+		}
+		if err := z.submit(true); err == nil {
+			for len(z.pending) > 0 && z.err == nil {
+				z.writeBlock()
+			}
+		}
+	}
+	if z.err == nil {
+		var trailer [8]byte
+		binary.LittleEndian.PutUint32(trailer[0:4], z.crc)
+		binary.LittleEndian.PutUint32(trailer[4:8], uint32(z.size))
+		z.err = z.write(trailer[:])
+	}
+	z.closed = true
+	close(z.work)
+	z.wg.Wait()
+	err := z.err
+	if err == nil {
+		// Later calls must not send blocks to the stopped workers.
+		z.err = errParallelWriterClosed
+	}
+	return err
+}
+
+func (z *ParallelWriter) newBlock() *parallelBlock {
+	if n := len(z.free); n > 0 {
+		blk := z.free[n-1]
+		z.free = z.free[:n-1]
+		blk.in = blk.in[:0]
+		return blk
+	}
+	return &parallelBlock{in: make([]byte, 0, z.opt.BlockSize)}
+}
+
+// submit sends z.block to the workers. If too many blocks are pending, it waits
+// for the oldest one and writes it to the output.
+func (z *ParallelWriter) submit(last bool) error {
+	blk := z.block
+	z.block = nil
+	blk.last = last
+	blk.dict = append(blk.dict[:0], z.dict...)
+	blk.done = make(chan struct{})
+	tail := blk.in
+	if len(tail) > maxDictSize {
+		tail = tail[len(tail)-maxDictSize:]
+	}
+	z.dict = append(z.dict[:0], tail...)
+
+	if z.nWorkers < z.opt.Concurrency {
+		d, err := newBlockDeflater(z.opt)
+		if err != nil {
+			z.err = err
+			return err
+		}
+		z.nWorkers++
+		z.wg.Add(1)
+		go z.runWorker(d)
+	}
+	z.pending = append(z.pending, blk)
+	z.work <- blk
+	for len(z.pending) > 2*z.opt.Concurrency && z.err == nil {
+		z.writeBlock()
+	}
+	return z.err
+}
+
+func (z *ParallelWriter) runWorker(d *blockDeflater) {
+	defer z.wg.Done()
+	defer d.close()
+	for blk := range z.work {
+		blk.crc = ChecksumCRC32(blk.in)
+		blk.out, blk.err = d.deflate(blk.out[:0], blk.dict, blk.in, blk.last)
+		close(blk.done)
+	}
+}
+
+// writeBlock waits for the oldest pending block and writes it to the output.
+func (z *ParallelWriter) writeBlock() {
+	blk := z.pending[0]
+	z.pending = z.pending[1:]
+	<-blk.done
+	if blk.err != nil {
+		z.err = blk.err
+		return
+	}
+	if !z.headerWritten {
+		z.headerWritten = true
+		if z.err = z.write(gzipHeaderBytes(z.header, z.opt.Level)); z.err != nil {
+			return
+		}
+	}
+	if z.err = z.write(blk.out); z.err != nil {
+		return
+	}
+	z.crc = CRC32Combine(z.crc, blk.crc, int64(len(blk.in)))
+	z.size += int64(len(blk.in))
+	z.free = append(z.free, blk)
+}
+
+func (z *ParallelWriter) write(data []byte) error {
+	n, err := z.out.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// gzipHeaderBytes produces a gzip member header, as defined in RFC1952 section
+// 2.3.
+func gzipHeaderBytes(h GzipHeader, level int) []byte {
+	const (
+		flagExtra   = 1 << 2
+		flagName    = 1 << 3
+		flagComment = 1 << 4
+	)
+	b := make([]byte, 10, 10+len(h.Extra)+len(h.Name)+len(h.Comment)+4)
+	b[0], b[1], b[2] = 0x1f, 0x8b, 8 // magic, CM=deflate
+	if len(h.Extra) > 0 {
+		b[3] |= flagExtra
+	}
+	if len(h.Name) > 0 {
+		b[3] |= flagName
+	}
+	if len(h.Comment) > 0 {
+		b[3] |= flagComment
+	}
+	if h.ModTime.After(time.Unix(0, 0)) {
+		binary.LittleEndian.PutUint32(b[4:8], uint32(h.ModTime.Unix()))
+	}
+	switch level {
+	case 9:
+		b[8] = 2 // XFL=maximum compression
+	case 1:
+		b[8] = 4 // XFL=fastest
+	}
+	b[9] = h.OS
+	if h.OS == 0 {
+		b[9] = 255
+	}
+	if len(h.Extra) > 0 {
+		b = append(b, byte(len(h.Extra)), byte(len(h.Extra)>>8))
+		b = append(b, h.Extra...)
+	}
+	if len(h.Name) > 0 {
+		b = append(b, h.Name...)
+		b = append(b, 0)
+	}
+	if len(h.Comment) > 0 {
+		b = append(b, h.Comment...)
+		b = append(b, 0)
+	}
+	return b
+}
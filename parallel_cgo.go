@@ -0,0 +1,66 @@
+// +build cgo,amd64
+
+package zlibng
+
+/*
+#include "./zlib-ng.h"
+#include "./zstream.h"
+*/
+import "C"
+
+import "unsafe"
+
+// blockDeflater compresses the blocks of a ParallelWriter. Each block is
+// compressed as a raw deflate stream that ends with a sync flush marker, so
+// that the blocks can be concatenated.
+type blockDeflater struct {
+	zs zstream
+}
+
+func newBlockDeflater(opt Opts) (*blockDeflater, error) {
+	d := &blockDeflater{}
+	ec := C.zs_deflate_init(&d.zs[0], C.int(opt.Level), C.int(Flate), C.int(opt.MemLevel), C.int(opt.Strategy))
+	if ec != 0 {
+		return nil, streamReturnCodeToError(&d.zs, ec)
+	}
+	return d, nil
+}
+
+// deflate compresses in, using dict as the preset dictionary, and appends the
+// result to out. If last is true, the result ends the deflate stream.
+func (d *blockDeflater) deflate(out, dict, in []byte, last bool) ([]byte, error) {
+	// A sync flush marker is at most 5 bytes, plus a few bits for the end of the
+	// last block. CompressBound is used rather than deflateBound, which doesn't
+	// cover the static Huffman codes of level 1.
+	bound := CompressBound(len(in)) + 16
+	if cap(out)-len(out) < bound {
+		newOut := make([]byte, len(out), len(out)+bound)
+		copy(newOut, out)
+		out = newOut
+	}
+	var (
+		dictPtr, inPtr unsafe.Pointer
+		outBuf         = out[len(out):cap(out)]
+		outLen         = C.int(len(outBuf))
+		cLast          C.int
+	)
+	if len(dict) > 0 {
+		dictPtr = unsafe.Pointer(&dict[0])
+	}
+	if len(in) > 0 {
+		inPtr = unsafe.Pointer(&in[0])
+	}
+	if last {
+		cLast = 1
+	}
+	ec := C.zs_deflate_block(&d.zs[0], dictPtr, C.int(len(dict)), inPtr, C.int(len(in)),
+		unsafe.Pointer(&outBuf[0]), &outLen, cLast)
+	if ec != 0 {
+		return out, zlibReturnCodeToError(ec)
+	}
+	return out[:len(out)+len(outBuf)-int(outLen)], nil
+}
+
+func (d *blockDeflater) close() {
+	_ = C.zs_deflate_free(&d.zs[0])
+}
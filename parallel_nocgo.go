@@ -0,0 +1,53 @@
+// +build !cgo !amd64
+
+package zlibng
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// blockDeflater compresses the blocks of a ParallelWriter. Each block is
+// compressed as a raw deflate stream that ends with a sync flush marker, so
+// that the blocks can be concatenated.
+type blockDeflater struct {
+	opt Opts
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newBlockDeflater(opt Opts) (*blockDeflater, error) {
+	level, err := writerLevel(opt)
+	if err != nil {
+		return nil, err
+	}
+	opt.Level = level
+	return &blockDeflater{opt: opt}, nil
+}
+
+// deflate compresses in, using dict as the preset dictionary, and appends the
+// result to out. If last is true, the result ends the deflate stream.
+func (d *blockDeflater) deflate(out, dict, in []byte, last bool) ([]byte, error) {
+	d.buf.Reset()
+	if d.w == nil {
+		var err error
+		if d.w, err = flate.NewWriterDict(&d.buf, d.opt.Level, dict); err != nil {
+			return out, err
+		}
+	} else {
+		d.w.ResetDict(&d.buf, dict)
+	}
+	if _, err := d.w.Write(in); err != nil {
+		return out, err
+	}
+	var err error
+	if last {
+		err = d.w.Close()
+	} else {
+		err = d.w.Flush()
+	}
+	return append(out, d.buf.Bytes()...), err
+}
+
+func (d *blockDeflater) close() {}
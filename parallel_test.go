@@ -0,0 +1,127 @@
+package zlibng_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/yasushi-saito/zlibng"
+)
+
+func parallelDeflate(t *testing.T, r *rand.Rand, data []byte, opts zlibng.Opts) []byte {
+	out := bytes.Buffer{}
+	zout, err := zlibng.NewParallelWriter(&out, opts)
+	assert.NoError(t, err)
+	for src := data; len(src) > 0; {
+		n := r.Intn(100000)
+		if n > len(src) {
+			n = len(src)
+		}
+		n2, err := zout.Write(src[:n])
+		assert.NoError(t, err)
+		assert.EQ(t, n, n2)
+		src = src[n:]
+	}
+	assert.NoError(t, zout.Close())
+	return out.Bytes()
+}
+
+func TestParallelDeflate(t *testing.T) {
+	const blockSize = 64 << 10
+	r := rand.New(rand.NewSource(0))
+	text := bytes.Repeat([]byte("Hello, world. Goodbye, world. "), 100000)
+	random := make([]byte, 1<<20)
+	_, err := r.Read(random)
+	assert.NoError(t, err)
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("Blah"),
+		text[:blockSize],
+		text[:3*blockSize],
+		text[:3*blockSize+1],
+		text,
+		random,
+	} {
+		t.Run(fmt.Sprintf("%d", len(data)), func(t *testing.T) {
+			var want []byte
+			for _, concurrency := range []int{1, 2, 8} {
+				got := parallelDeflate(t, r, data, zlibng.Opts{Level: 5, Concurrency: concurrency, BlockSize: blockSize})
+				if want == nil {
+					want = got
+				} else if !bytes.Equal(got, want) {
+					t.Fatalf("concurrency %d: output differs", concurrency)
+				}
+			}
+			zin, err := gzip.NewReader(bytes.NewReader(want))
+			assert.NoError(t, err)
+			zin.Multistream(false)
+			got, err := ioutil.ReadAll(zin)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+
+			// The output must be a single gzip member.
+			assert.EQ(t, zin.Reset(bytes.NewReader(nil)), io.EOF)
+		})
+	}
+}
+
+func TestParallelDeflateIncompressible(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 1<<20)
+	_, err := r.Read(data)
+	assert.NoError(t, err)
+	for _, level := range []int{0, 1, 2, 9} {
+		got := parallelDeflate(t, r, data, zlibng.Opts{Level: level, Concurrency: 3})
+		zin, err := gzip.NewReader(bytes.NewReader(got))
+		assert.NoError(t, err)
+		uncompressed, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err, "level=%d", level)
+		assert.True(t, bytes.Equal(uncompressed, data), "level=%d", level)
+	}
+}
+
+func TestParallelWriteAfterClose(t *testing.T) {
+	out := bytes.Buffer{}
+	zout, err := zlibng.NewParallelWriter(&out)
+	assert.NoError(t, err)
+	_, err = zout.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	n := out.Len()
+
+	_, err = zout.Write(make([]byte, 1<<20))
+	assert.Regexp(t, err, "writer is closed")
+	assert.Regexp(t, zout.SetHeader(zlibng.GzipHeader{Name: "x"}), "writer is closed")
+	assert.Regexp(t, zout.Close(), "writer is closed")
+	assert.EQ(t, out.Len(), n)
+}
+
+func TestParallelDeflateHeader(t *testing.T) {
+	out := bytes.Buffer{}
+	zout, err := zlibng.NewParallelWriter(&out)
+	assert.NoError(t, err)
+	now := time.Unix(time.Now().Unix(), 0)
+	assert.NoError(t, zout.SetHeader(zlibng.GzipHeader{Comment: "hello", Name: "blah", Extra: []byte{3, 2, 1}, ModTime: now, OS: 11}))
+	data := []byte("testdata")
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), string(data))
+	assert.EQ(t, zin.Comment, "hello")
+	assert.EQ(t, zin.Name, "blah")
+	assert.EQ(t, zin.Extra, []byte{3, 2, 1})
+	assert.True(t, zin.ModTime.Equal(now))
+	assert.EQ(t, zin.OS, byte(11))
+}
@@ -64,6 +64,20 @@ def patch_file(src_path: str, dst_path: str):
         ('zcfree', 'zng_zcfree'),
         #('const ct_data static_ltree', 'extern const ct_data static_ltree'),
         ('zng_functable.h\"', 'functable.h"'),  # undo the include name change
+        # deflate_medium must not emit distances beyond the configured window.
+        ('#define MAX_DIST2  ((1 << MAX_WBITS) - MIN_LOOKAHEAD)', '#define MAX_DIST2  MAX_DIST(s)'),
+        # deflateInit2 must not touch s->prev if the allocation failed.
+        ('    memset(s->prev, 0, s->w_size * sizeof(Pos));',
+         '    if (s->prev != NULL)\n        memset(s->prev, 0, s->w_size * sizeof(Pos));'),
+        # deflate_quick must not return before the end of a sync flush while there
+        # is room in the output, or the caller takes the flush to be complete.
+        ('            if (flush != Z_FINISH) {',
+         '            if (s->strm->avail_out == 0 && flush != Z_FINISH) {'),
+        # inflate must not copy the gzip Extra field past extra_max when the field
+        # arrives in several pieces (CVE-2022-37434).
+        ('                        state->head->extra != NULL) {',
+         '                        state->head->extra != NULL &&\n'
+         '                        state->head->extra_len - state->length < state->head->extra_max) {'),
     ]
     logging.info('%s -> %s', src_path, dst_path)
     with open(src_path) as in_fd, open(dst_path, 'w') as out_fd:
@@ -10,6 +10,7 @@ package zlibng
 
 #include <errno.h>
 #include <stdlib.h>
+#include <string.h>
 #include "./zlib-ng.h"
 #include "./zstream.h"
 
@@ -17,6 +18,7 @@ package zlibng
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -27,7 +29,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-type zstream [unsafe.Sizeof(C.zng_stream{})]C.char
+// zstream is a zng_stream followed by a zs_mem. See zstream.h.
+type zstream [unsafe.Sizeof(C.zng_stream{}) + unsafe.Sizeof(C.zs_mem{})]C.char
 
 // Reader is a gzip/zlib/flate reader. It implements io.ReadCloser.  Calling
 // Close is optional, though strongly recommended.  NewReader() also installs a
@@ -35,18 +38,46 @@ type zstream [unsafe.Sizeof(C.zng_stream{})]C.char
 // Close.
 type Reader struct {
 	in          io.Reader
-	inConsumed  bool    // true if zstream has finished consuming the current input buffer.
-	inEOF       bool    // true if in reaches io.EOF
-	hasGzHeader bool    // true if gzHeader was successfully set.
-	zs          zstream // underlying zlib implementation.
+	inConsumed  bool          // true if zstream has finished consuming the current input buffer.
+	inPending   int           // # of bytes at the start of inBuf not yet passed to zstream.
+	inEOF       bool          // true if in reaches io.EOF
+	memberEnd   bool          // true if zstream has reached the end of a gzip member.
+	outFull     bool          // true if the last zs_inflate filled its output buffer.
+	member      int           // index of the current gzip member.
+	inBase      int64         // # of compressed bytes in the preceding members.
+	outBase     int64         // # of uncompressed bytes in the preceding members.
+	inRead      int64         // # of bytes read from in.
+	cgoTime     time.Duration // time spent in zs_inflate.
+	multistream bool          // see Multistream.
+	hasGzHeader bool          // true if gzHeader was successfully set.
+	closed      bool          // true if zs doesn't hold an initialized inflate state.
+	zs          zstream       // underlying zlib implementation.
 	gzHeader    C.zng_gz_header
 	inBuf       []byte
+	outBuf      []byte // output buffer of WriteTo. Allocated on demand.
 	err         error
+	opt         Opts            // options, with defaults filled in.
+	ctx         context.Context // see NewReaderContext. May be nil.
+
+	// Buffers for the gzip header fields. They are owned by the reader. Inflate
+	// resets the fields in gzHeader to NULL when they are absent from the stream,
+	// so gzHeader can't be used to track them.
+	gzComment, gzName, gzExtra *C.uchar
+	gzBufSize                  int // size of gzExtra, <= Opts.MaxHeaderField. The others have one more byte.
 }
 
+const (
+	// gzHeaderChunk is the initial size of the gzip header buffers. They grow
+	// up to Opts.MaxHeaderField as inflate parses a header with longer fields.
+	gzHeaderChunk = 256
+	// gzFixedHeader is the size of the part of a gzip header before the optional
+	// fields.
+	gzFixedHeader = 10
+)
+
 func freeReader(z *Reader) {
 	_ = C.zs_inflate_end(&z.zs[0])
-	freeGzHeaderFields(&z.gzHeader)
+	z.freeGzHeaderBufs()
 }
 
 // NewReader creates a gzip/flate reader. There can be at most one options arg.
@@ -55,34 +86,329 @@ func NewReader(in io.Reader, opts ...Opts) (*Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	if opt.WindowBits == 0 {
+	z := &Reader{closed: true}
+	if err := z.init(in, opt); err != nil {
+		_ = z.Close()
+		return nil, err
+	}
+	return z, nil
+}
+
+// NewReaderContext is similar to NewReader, but Read checks ctx between inflate
+// chunks, and it returns ctx.Err() once ctx is done. The reader keeps using ctx
+// after Reset.
+func NewReaderContext(ctx context.Context, in io.Reader, opts ...Opts) (*Reader, error) {
+	z, err := NewReader(in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	z.ctx = ctx
+	return z, nil
+}
+
+// Reset discards the reader's state and makes it equivalent to the result of
+// NewReader(in, opts...), but it reuses the buffers and, unless the reader has
+// been closed, the inflate state. The options may specify a different format
+// from the one used previously. If opts is empty, the options passed to the
+// last NewReader or Reset call are reused.
+func (z *Reader) Reset(in io.Reader, opts ...Opts) error {
+	opt := z.opt
+	if len(opts) > 0 {
+		var err error
+		if opt, err = getOpts(opts...); err != nil {
+			return err
+		}
+	}
+	return z.init(in, opt)
+}
+
+func (z *Reader) init(in io.Reader, opt Opts) error {
+	if opt.Format == FormatAuto {
+		var err error
+		if in, opt.WindowBits, err = sniffFormat(in, opt.WindowSize); err != nil {
+			return err
+		}
+	} else if opt.WindowBits == 0 {
 		opt.WindowBits = 32 + 15 // autodetect gzip/zlib
 	}
-	z := &Reader{
-		in:         in,
-		inBuf:      make([]byte, opt.Buffer),
-		inConsumed: true, // force in.Read
-	}
-	const maxStringLen = 256 // TODO(saito): allow setting the header length.
-	z.gzHeader.comment = (*C.uchar)(C.malloc(maxStringLen))
-	z.gzHeader.comm_max = maxStringLen
-	z.gzHeader.name = (*C.uchar)(C.malloc(maxStringLen))
-	z.gzHeader.name_max = maxStringLen
-	z.gzHeader.extra = (*C.uchar)(C.malloc(maxStringLen))
-	z.gzHeader.extra_max = maxStringLen
+	if len(z.inBuf) != opt.Buffer {
+		z.inBuf = make([]byte, opt.Buffer)
+	}
+	z.in = in
+	z.inConsumed = true // force in.Read
+	z.inPending = 0
+	z.inEOF = false
+	z.memberEnd = false
+	z.outFull = false
+	z.member = 0
+	z.inBase = 0
+	z.outBase = 0
+	z.inRead = 0
+	z.cgoTime = 0
+	z.multistream = true
+	z.err = nil
+	z.opt = opt
+	z.resetGzHeader()
 	var getHeaderStatus C.int
-	if ec := C.zs_inflate_init(&z.zs[0], C.int(opt.WindowBits), &z.gzHeader, &getHeaderStatus); ec != 0 {
-		return nil, zlibReturnCodeToError(ec)
+	if z.closed {
+		// zs_inflate_init clears the memory accounting of zs.
+		z.freeGzHeaderBufs()
+		if ec := C.zs_inflate_init(&z.zs[0], C.int(opt.WindowBits), &z.gzHeader, &getHeaderStatus); ec != 0 {
+			return streamReturnCodeToError(&z.zs, ec)
+		}
+		z.closed = false
+		runtime.SetFinalizer(z, freeReader)
+	} else {
+		if ec := C.zs_inflate_reset2(&z.zs[0], C.int(opt.WindowBits), &z.gzHeader, &getHeaderStatus); ec != 0 {
+			return zlibReturnCodeToError(ec)
+		}
 	}
-	if getHeaderStatus == 0 {
-		z.hasGzHeader = true
+	z.hasGzHeader = (getHeaderStatus == 0)
+	if err := z.allocGzHeaderBufs(); err != nil {
+		return err
 	}
-	runtime.SetFinalizer(z, freeReader)
-	return z, nil
+	return z.setRawDictionary()
+}
+
+// allocGzHeaderBufs allocates the buffers for the gzip header fields if the
+// stream may have a gzip header, and frees them otherwise. The buffers start
+// small and grow in headerInputLimit. They are allocated through zs, so they
+// count towards MemoryInUse and SetMemoryLimit.
+func (z *Reader) allocGzHeaderBufs() error {
+	if !z.hasGzHeader {
+		z.freeGzHeaderBufs()
+		return nil
+	}
+	if z.gzComment == nil || z.gzBufSize > z.opt.MaxHeaderField {
+		z.freeGzHeaderBufs()
+		n := gzHeaderChunk
+		if n > z.opt.MaxHeaderField {
+			n = z.opt.MaxHeaderField
+		}
+		// The extra byte in the string buffers is used to detect truncation.
+		z.gzComment = (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n+1)))
+		z.gzName = (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n+1)))
+		z.gzExtra = (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n)))
+		if z.gzComment == nil || z.gzName == nil || z.gzExtra == nil {
+			z.freeGzHeaderBufs()
+			z.hasGzHeader = false
+			return streamReturnCodeToError(&z.zs, C.Z_MEM_ERROR)
+		}
+		z.gzBufSize = n
+	}
+	z.resetGzHeader()
+	return nil
+}
+
+// headerInputLimit returns the most input that the next inflate call may
+// consume, or 0 if there is no limit. While inflate parses a gzip header, it
+// copies at most one byte to the header buffers per input byte, so the input is
+// limited to the room left in the buffers, and the buffers grow between the
+// calls until they reach Opts.MaxHeaderField.
+func (z *Reader) headerInputLimit() (int, error) {
+	if !z.hasGzHeader || z.gzHeader.done != 0 || z.gzBufSize >= z.opt.MaxHeaderField {
+		return 0, nil
+	}
+	used := int(C.zs_get_total_in(&z.zs[0])) - gzFixedHeader
+	if used < 0 {
+		used = 0
+	}
+	if z.gzBufSize-used < gzHeaderChunk {
+		n := 2 * z.gzBufSize
+		if n < used+gzHeaderChunk {
+			n = used + gzHeaderChunk
+		}
+		if n > z.opt.MaxHeaderField {
+			n = z.opt.MaxHeaderField
+		}
+		if err := z.growGzHeaderBufs(n); err != nil {
+			return 0, err
+		}
+		if n == z.opt.MaxHeaderField {
+			// Inflate truncates the fields to the buffers from now on.
+			return 0, nil
+		}
+	}
+	return z.gzBufSize - used, nil
+}
+
+// growGzHeaderBufs replaces the gzip header buffers with larger ones of n
+// bytes, keeping their contents.
+func (z *Reader) growGzHeaderBufs(n int) error {
+	comment := (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n+1)))
+	name := (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n+1)))
+	extra := (*C.uchar)(C.zs_mem_alloc(&z.zs[0], C.size_t(n)))
+	newBufs := []*C.uchar{comment, name, extra}
+	if comment == nil || name == nil || extra == nil {
+		for _, p := range newBufs {
+			if p != nil {
+				C.zs_mem_free(&z.zs[0], unsafe.Pointer(p))
+			}
+		}
+		return streamReturnCodeToError(&z.zs, C.Z_MEM_ERROR)
+	}
+	C.memcpy(unsafe.Pointer(comment), unsafe.Pointer(z.gzComment), C.size_t(z.gzBufSize+1))
+	C.memcpy(unsafe.Pointer(name), unsafe.Pointer(z.gzName), C.size_t(z.gzBufSize+1))
+	C.memcpy(unsafe.Pointer(extra), unsafe.Pointer(z.gzExtra), C.size_t(z.gzBufSize))
+	// The fields that inflate has set to NULL stay NULL.
+	if z.gzHeader.comment != nil {
+		z.gzHeader.comment = comment
+		z.gzHeader.comm_max = C.uint(n + 1)
+	}
+	if z.gzHeader.name != nil {
+		z.gzHeader.name = name
+		z.gzHeader.name_max = C.uint(n + 1)
+	}
+	if z.gzHeader.extra != nil {
+		z.gzHeader.extra = extra
+		z.gzHeader.extra_max = C.uint(n)
+	}
+	for i, p := range []**C.uchar{&z.gzComment, &z.gzName, &z.gzExtra} {
+		C.zs_mem_free(&z.zs[0], unsafe.Pointer(*p))
+		*p = newBufs[i]
+	}
+	z.gzBufSize = n
+	return nil
+}
+
+// resetGzHeader points the gzip header fields to the reader-owned buffers, if
+// any.
+func (z *Reader) resetGzHeader() {
+	z.gzHeader = C.zng_gz_header{}
+	if z.gzComment == nil {
+		return
+	}
+	*z.gzComment = 0
+	z.gzHeader.comment = z.gzComment
+	z.gzHeader.comm_max = C.uint(z.gzBufSize + 1)
+	*z.gzName = 0
+	z.gzHeader.name = z.gzName
+	z.gzHeader.name_max = C.uint(z.gzBufSize + 1)
+	z.gzHeader.extra = z.gzExtra
+	z.gzHeader.extra_max = C.uint(z.gzBufSize)
+}
+
+func (z *Reader) freeGzHeaderBufs() {
+	for _, p := range []**C.uchar{&z.gzComment, &z.gzName, &z.gzExtra} {
+		if *p != nil {
+			C.zs_mem_free(&z.zs[0], unsafe.Pointer(*p))
+			*p = nil
+		}
+	}
+	z.gzHeader = C.zng_gz_header{}
+}
+
+// setRawDictionary sets the preset dictionary for a raw (Flate) stream. Raw
+// streams don't record the dictionary, so it must be set before reading any
+// data. Other formats set the dictionary in response to Z_NEED_DICT.
+func (z *Reader) setRawDictionary() error {
+	if z.opt.WindowBits >= 0 || len(z.opt.Dictionary) == 0 {
+		return nil
+	}
+	ec := C.zs_inflate_set_dictionary(&z.zs[0], unsafe.Pointer(&z.opt.Dictionary[0]), C.int(len(z.opt.Dictionary)))
+	return zlibReturnCodeToError(ec)
+}
+
+// setDictionary is called when inflate returns Z_NEED_DICT.
+func (z *Reader) setDictionary() error {
+	dict := z.opt.Dictionary
+	if z.opt.DictionaryFunc != nil {
+		var err error
+		if dict, err = z.opt.DictionaryFunc(uint32(C.zs_get_adler(&z.zs[0]))); err != nil {
+			return err
+		}
+	}
+	if len(dict) == 0 {
+		return zlibReturnCodeToError(C.Z_NEED_DICT)
+	}
+	ec := C.zs_inflate_set_dictionary(&z.zs[0], unsafe.Pointer(&dict[0]), C.int(len(dict)))
+	return zlibReturnCodeToError(ec)
+}
+
+// Multistream controls whether the reader supports multi-member gzip files.
+// By default, the reader reads all the members as one continuous stream. If ok
+// is false, Read returns io.EOF at the end of each member, and NextMember
+// advances to the next member. Reset re-enables multistream mode.
+//
+// Raw (Flate) streams have no members. Read always returns io.EOF at the end of
+// the deflate stream, and the trailing data, if any, is ignored.
+func (z *Reader) Multistream(ok bool) {
+	z.multistream = ok
+}
+
+// NextMember advances to the next member of a multi-member gzip file. The rest
+// of the current member, if any, is discarded. It returns io.EOF if there are
+// no more members. It is typically used after Multistream(false).
+func (z *Reader) NextMember() error {
+	if z.opt.WindowBits < 0 {
+		return errors.New("zlibng.NextMember: raw flate streams have no members")
+	}
+	if !z.memberEnd {
+		multistream := z.multistream
+		z.multistream = false
+		var buf [4096]byte
+		for z.err == nil {
+			_, _ = z.Read(buf[:])
+		}
+		z.multistream = multistream
+		if !z.memberEnd {
+			return z.err
+		}
+	}
+	if z.inConsumed && z.inPending == 0 {
+		if z.err = z.fillInput(); z.err != nil {
+			return z.err
+		}
+	}
+	z.err = z.resetMember()
+	return z.err
+}
+
+// resetMember prepares zstream for the next gzip member.
+func (z *Reader) resetMember() error {
+	in := z.inBase + int64(C.zs_get_total_in(&z.zs[0]))
+	out := z.outBase + int64(C.zs_get_total_out(&z.zs[0]))
+	if err := checkMaxMembers(z.opt, in, out, z.member+1); err != nil {
+		return err
+	}
+	z.memberEnd = false
+	z.member++
+	z.inBase, z.outBase = in, out
+	z.resetGzHeader()
+	var getHeaderStatus C.int
+	if ec := C.zs_inflate_reset(&z.zs[0], &z.gzHeader, &getHeaderStatus); ec != 0 {
+		return zlibReturnCodeToError(ec)
+	}
+	z.hasGzHeader = (getHeaderStatus == 0)
+	return nil
+}
+
+// fillInput reads the next chunk of input into inBuf. It returns io.EOF if
+// there is no more input.
+func (z *Reader) fillInput() error {
+	if z.inEOF {
+		return io.EOF
+	}
+	n, err := z.in.Read(z.inBuf)
+	z.inRead += int64(n)
+	if err != nil {
+		if err != io.EOF {
+			return err
+		}
+		z.inEOF = true
+	}
+	if n == 0 {
+		if !z.inEOF {
+			panic(z)
+		}
+		return io.EOF
+	}
+	z.inPending = n
+	return nil
 }
 
 // Header reads the gzip header contents. If the file is a multi-gzip
-// concatenation, this function returns the contents of the current archive.
+// concatenation, this function returns the contents of the current member.
 //
 // REQUIRES: Opts.GetGzipHeader=true when the reader was created.
 func (z *Reader) Header() (GzipHeader, error) {
@@ -91,13 +417,18 @@ func (z *Reader) Header() (GzipHeader, error) {
 	}
 	h := GzipHeader{}
 	if z.gzHeader.comment != nil {
-		h.Comment = C.GoString((*C.char)(unsafe.Pointer(z.gzHeader.comment)))
+		h.Comment = z.headerString(z.gzHeader.comment, &h.Truncated)
 	}
 	if z.gzHeader.extra != nil {
-		h.Extra = C.GoBytes(unsafe.Pointer(z.gzHeader.extra), C.int(z.gzHeader.extra_len))
+		n := int(z.gzHeader.extra_len)
+		if n > z.gzBufSize {
+			n = z.gzBufSize
+			h.Truncated = true
+		}
+		h.Extra = C.GoBytes(unsafe.Pointer(z.gzHeader.extra), C.int(n))
 	}
 	if z.gzHeader.name != nil {
-		h.Name = C.GoString((*C.char)(unsafe.Pointer(z.gzHeader.name)))
+		h.Name = z.headerString(z.gzHeader.name, &h.Truncated)
 	}
 	if z.gzHeader.time > 0 {
 		h.ModTime = time.Unix(int64(z.gzHeader.time), 0)
@@ -106,11 +437,27 @@ func (z *Reader) Header() (GzipHeader, error) {
 	return h, nil
 }
 
+// headerString converts a comment or name field in gzHeader to a string. Inflate
+// copies at most gzBufSize+1 bytes, including the NUL terminator, to the buffer.
+// The terminator is missing if the field has been truncated.
+func (z *Reader) headerString(p *C.uchar, truncated *bool) string {
+	n := int(C.strnlen((*C.char)(unsafe.Pointer(p)), C.size_t(z.gzBufSize+1)))
+	if n > z.gzBufSize {
+		*truncated = true
+		n = z.gzBufSize
+	}
+	return C.GoStringN((*C.char)(unsafe.Pointer(p)), C.int(n))
+}
+
 // Close implements io.Closer.
 func (z *Reader) Close() error {
-	runtime.SetFinalizer(z, nil)
-	ec := C.zs_inflate_end(&z.zs[0])
-	freeGzHeaderFields(&z.gzHeader)
+	var ec C.int
+	if !z.closed {
+		runtime.SetFinalizer(z, nil)
+		ec = C.zs_inflate_end(&z.zs[0])
+		z.closed = true
+	}
+	z.freeGzHeaderBufs()
 	if z.err == io.EOF {
 		return zlibReturnCodeToError(ec)
 	}
@@ -121,60 +468,158 @@ func (z *Reader) Close() error {
 func (z *Reader) Read(out []byte) (int, error) {
 	var orgOut = out
 	for z.err == nil && len(out) > 0 {
-		var (
-			outLen     = C.int(len(out))
-			ret        C.int
-			inConsumed C.int
-		)
-		if !z.inConsumed {
-			ret = C.zs_inflate(&z.zs[0], nil, 0, unsafe.Pointer(&out[0]), &outLen, &inConsumed)
-		} else {
-			if z.inEOF {
+		if z.ctx != nil {
+			if err := z.ctx.Err(); err != nil {
+				return len(orgOut) - len(out), err
+			}
+		}
+		if z.memberEnd {
+			if !z.multistream || z.opt.WindowBits < 0 {
 				z.err = io.EOF
 				break
 			}
-			n, err := z.in.Read(z.inBuf)
-			if err != nil {
-				if err != io.EOF {
-					z.err = err
+			// Start the next member, if any. The reset is delayed until here so that
+			// Header reports the last member at the end of the file.
+			if z.inConsumed && z.inPending == 0 {
+				if z.err = z.fillInput(); z.err != nil {
 					break
 				}
-				z.inEOF = true
-				// fall through
 			}
-			if n == 0 {
-				if !z.inEOF {
-					panic(z)
-				}
-				z.err = io.EOF
+			if z.err = z.resetMember(); z.err != nil {
 				break
 			}
-			ret = C.zs_inflate(&z.zs[0], unsafe.Pointer(&z.inBuf[0]), C.int(n), unsafe.Pointer(&out[0]), &outLen, &inConsumed)
 		}
+		drain := false
+		if z.inConsumed && z.inPending == 0 {
+			if z.err = z.fillInput(); z.err != nil {
+				if z.err != io.EOF {
+					break
+				}
+				if !z.outFull {
+					// The input ended before the end of the member.
+					z.err = newTruncatedError(&z.zs, z.inBase, z.outBase, z.member)
+					break
+				}
+				// zstream may hold output for the input it has consumed, since the last
+				// call filled its output buffer. Inflate again with no new input.
+				z.err = nil
+				drain = true
+			}
+		}
+		// Inflate at most one byte more than the limits allow, to detect the
+		// crossing.
+		chunk := out
+		if z.ctx != nil && len(chunk) > contextChunkSize {
+			chunk = chunk[:contextChunkSize]
+		}
+		allowed, limited := outputAllowance(z.opt, z.inRead, z.outBase+int64(C.zs_get_total_out(&z.zs[0])))
+		if limited && int64(len(chunk)) > allowed {
+			chunk = chunk[:allowed+1]
+		}
+		var (
+			outLen     = C.int(len(chunk))
+			ret        C.int
+			inConsumed C.int
+		)
+		maxIn, err := z.headerInputLimit()
+		if err != nil {
+			z.err = err
+			break
+		}
+		var (
+			in  unsafe.Pointer
+			nIn C.int
+		)
+		if !drain && z.inConsumed {
+			in, nIn = unsafe.Pointer(&z.inBuf[0]), C.int(z.inPending)
+			z.inPending = 0
+		}
+		start := time.Now()
+		if maxIn > 0 {
+			ret = C.zs_inflate_header(&z.zs[0], in, nIn, C.int(maxIn), unsafe.Pointer(&chunk[0]), &outLen, &inConsumed)
+		} else {
+			ret = C.zs_inflate(&z.zs[0], in, nIn, unsafe.Pointer(&chunk[0]), &outLen, &inConsumed)
+		}
+		z.cgoTime += time.Since(start)
 		z.inConsumed = (inConsumed != 0)
+		z.outFull = (outLen == 0)
+		if drain && ret == C.Z_BUF_ERROR {
+			// Inflate made no progress, so the input ended before the end of the
+			// member.
+			z.err = newTruncatedError(&z.zs, z.inBase, z.outBase, z.member)
+			break
+		}
+		if ret == C.Z_NEED_DICT {
+			if z.err = z.setDictionary(); z.err == ErrNeedDict {
+				z.err = newStreamError(&z.zs, ret, z.inBase, z.outBase, z.member)
+			}
+			continue
+		}
 		if ret != C.Z_STREAM_END && ret != C.Z_OK {
-			z.err = zlibReturnCodeToError(ret)
+			z.err = newStreamError(&z.zs, ret, z.inBase, z.outBase, z.member)
+			break
+		}
+		nOut := len(chunk) - int(outLen)
+		if limited && int64(nOut) > allowed {
+			// Drop the extra byte.
+			out = out[allowed:]
+			z.err = newOutputLimitError(z.opt, z.inBase+int64(C.zs_get_total_in(&z.zs[0])),
+				z.outBase+int64(C.zs_get_total_out(&z.zs[0]))-1, z.member)
 			break
 		}
-		nOut := len(out) - int(outLen)
 		out = out[nOut:]
 		if ret == C.Z_STREAM_END {
-			ret = C.zs_inflate_reset(&z.zs[0])
-			if ret != C.Z_OK {
-				z.err = zlibReturnCodeToError(ret)
-			}
-			break
+			z.memberEnd = true
 		}
 	}
 	return len(orgOut) - len(out), z.err
 }
 
+// WriteTo implements io.WriterTo. It decompresses the rest of the stream into
+// w. If w is a *bytes.Buffer, inflate writes into the buffer's unused capacity,
+// which is grown by at least Opts.Buffer bytes first. Otherwise, including when
+// w is an *os.File, inflate writes into a buffer of Opts.Buffer bytes that is
+// passed to w.Write as is.
+func (z *Reader) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(z, w, &z.outBuf, z.opt.Buffer)
+}
+
+// Stats reports the progress of the reader. Compressed counts the bytes consumed
+// by inflate, so it doesn't include input that has been read ahead into the
+// reader's buffer.
+func (z *Reader) Stats() Stats {
+	totalIn := int64(C.zs_get_total_in(&z.zs[0]))
+	s := Stats{
+		Compressed:   z.inBase + totalIn,
+		Uncompressed: z.outBase + int64(C.zs_get_total_out(&z.zs[0])),
+		Members:      z.member,
+		CgoTime:      z.cgoTime,
+	}
+	if totalIn > 0 || z.memberEnd {
+		s.Members++
+	}
+	if z.opt.WindowBits >= 0 {
+		s.Checksum = uint32(C.zs_get_adler(&z.zs[0]))
+	}
+	return s
+}
+
 // Writer is the gzip/flate writer. It implements io.WriterCloser.
 type Writer struct {
 	out      io.Writer
 	zs       zstream // underlying zlib implementation.
+	closed   bool    // true if zs doesn't hold an initialized deflate state.
 	gzHeader C.zng_gz_header
 	outBuf   []byte
+	inBuf    []byte          // input buffer of ReadFrom. Allocated on demand.
+	cgoTime  time.Duration   // time spent in zs_deflate*.
+	opt      Opts            // options, with defaults filled in.
+	ctx      context.Context // see NewWriterContext. May be nil.
+}
+
+func freeWriter(z *Writer) {
+	_ = C.zs_deflate_free(&z.zs[0])
+	freeGzHeaderFields(&z.gzHeader)
 }
 
 // NewWriter creates a gzip/flate writer. There can be at most one options arg.
@@ -184,9 +629,44 @@ func NewWriter(w io.Writer, opts ...Opts) (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	z := &Writer{
-		out:    w,
-		outBuf: make([]byte, opt.Buffer),
+	z := &Writer{closed: true}
+	if err := z.init(w, opt); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// NewWriterContext is similar to NewWriter, but Write checks ctx between
+// deflate chunks, and it returns ctx.Err() once ctx is done. The writer keeps
+// using ctx after Reset.
+func NewWriterContext(ctx context.Context, w io.Writer, opts ...Opts) (*Writer, error) {
+	z, err := NewWriter(w, opts...)
+	if err != nil {
+		return nil, err
+	}
+	z.ctx = ctx
+	return z, nil
+}
+
+// Reset discards the writer's state and makes it equivalent to the result of
+// NewWriter(w, opts...), but it reuses the buffers and, unless the writer has
+// been closed or the options change the deflateInit2 parameters, the deflate
+// state. If opts is empty, the options passed to the last NewWriter or Reset
+// call are reused. The header set by SetHeader is discarded.
+func (z *Writer) Reset(w io.Writer, opts ...Opts) error {
+	opt := z.opt
+	if len(opts) > 0 {
+		var err error
+		if opt, err = getOpts(opts...); err != nil {
+			return err
+		}
+	}
+	return z.init(w, opt)
+}
+
+func (z *Writer) init(w io.Writer, opt Opts) error {
+	if opt.Format == FormatAuto {
+		return errAutoWriter
 	}
 	if opt.WindowBits == 0 {
 		opt.WindowBits = Gzip
@@ -197,12 +677,71 @@ func NewWriter(w io.Writer, opts ...Opts) (*Writer, error) {
 	if opt.Strategy == 0 {
 		opt.Strategy = DefaultStrategy
 	}
-	ec := C.zs_deflate_init(&z.zs[0], C.int(opt.Level),
-		C.int(opt.WindowBits), C.int(opt.MemLevel), C.int(opt.Strategy))
-	if ec != 0 {
-		return nil, zlibReturnCodeToError(ec)
+	if len(opt.Dictionary) > 0 && opt.WindowBits > 15 {
+		return errors.New("zlibng.NewWriter: Dictionary cannot be used with the Gzip format")
 	}
-	return z, nil
+	if len(z.outBuf) != opt.Buffer {
+		z.outBuf = make([]byte, opt.Buffer)
+	}
+	z.out = w
+	z.cgoTime = 0
+	sameParams := opt.Level == z.opt.Level && opt.WindowBits == z.opt.WindowBits &&
+		opt.MemLevel == z.opt.MemLevel && opt.Strategy == z.opt.Strategy
+	z.opt = opt
+	if !z.closed && sameParams {
+		if ec := C.zs_deflate_reset(&z.zs[0]); ec != 0 {
+			return zlibReturnCodeToError(ec)
+		}
+	} else {
+		z.free()
+		ec := C.zs_deflate_init(&z.zs[0], C.int(opt.Level),
+			C.int(opt.WindowBits), C.int(opt.MemLevel), C.int(opt.Strategy))
+		if ec != 0 {
+			return streamReturnCodeToError(&z.zs, ec)
+		}
+		z.closed = false
+		runtime.SetFinalizer(z, freeWriter)
+	}
+	freeGzHeaderFields(&z.gzHeader)
+	// deflateReset restores the parameters of the level, so Tune is applied after
+	// every reset.
+	if err := z.tune(); err != nil {
+		z.free()
+		return err
+	}
+	if len(opt.Dictionary) > 0 {
+		ec := C.zs_deflate_set_dictionary(&z.zs[0], unsafe.Pointer(&opt.Dictionary[0]), C.int(len(opt.Dictionary)))
+		if ec != 0 {
+			z.free()
+			return zlibReturnCodeToError(ec)
+		}
+	}
+	return nil
+}
+
+// free frees the deflate state, if any.
+func (z *Writer) free() {
+	if !z.closed {
+		runtime.SetFinalizer(z, nil)
+		_ = C.zs_deflate_free(&z.zs[0])
+		z.closed = true
+	}
+}
+
+// abort frees the deflate state without finishing the stream.
+func (z *Writer) abort() {
+	freeGzHeaderFields(&z.gzHeader)
+	z.free()
+}
+
+// tune applies z.opt.Tune to the deflate state.
+func (z *Writer) tune() error {
+	t := z.opt.Tune
+	if t == (Tune{}) {
+		return nil
+	}
+	ec := C.zs_deflate_tune(&z.zs[0], C.int(t.GoodLength), C.int(t.MaxLazy), C.int(t.NiceLength), C.int(t.MaxChain))
+	return zlibReturnCodeToError(ec)
 }
 
 // SetHeader sets the Gzip header contents.
@@ -244,6 +783,96 @@ func (z *Writer) flush(data []byte) error {
 	return nil
 }
 
+// Flush compresses all the data written so far and writes it to the output,
+// using Z_SYNC_FLUSH. The output is aligned on a byte boundary, so a reader can
+// decompress everything written before the Flush call without waiting for
+// Close.
+func (z *Writer) Flush() error {
+	return z.deflateFlush(C.Z_SYNC_FLUSH)
+}
+
+// FlushPartial is similar to Flush, but it uses Z_PARTIAL_FLUSH. The output is
+// not byte aligned, but it is a few bytes shorter than with Flush.
+func (z *Writer) FlushPartial() error {
+	return z.deflateFlush(C.Z_PARTIAL_FLUSH)
+}
+
+// FlushFull is similar to Flush, but it uses Z_FULL_FLUSH. It also resets the
+// compression state, so that a reader can restart decompression from this
+// point. Using FlushFull too often can degrade compression seriously.
+func (z *Writer) FlushFull() error {
+	return z.deflateFlush(C.Z_FULL_FLUSH)
+}
+
+// FlushBlock completes the current deflate block and writes it to the output,
+// using Z_BLOCK. Up to seven bits of the block may be held back until the next
+// block is written, so the output is not necessarily decodable to the end.
+func (z *Writer) FlushBlock() error {
+	return z.deflateFlush(C.Z_BLOCK)
+}
+
+// deflateFlush calls deflate with the given flush mode until all the pending
+// output is written to z.out.
+func (z *Writer) deflateFlush(mode C.int) error {
+	for {
+		outLen := C.int(len(z.outBuf))
+		start := time.Now()
+		ret := C.zs_deflate_flush(&z.zs[0], mode, unsafe.Pointer(&z.outBuf[0]), &outLen)
+		z.cgoTime += time.Since(start)
+		// Z_BUF_ERROR means there was nothing more to flush.
+		if ret != C.Z_OK && ret != C.Z_BUF_ERROR {
+			return zlibReturnCodeToError(ret)
+		}
+		nOut := len(z.outBuf) - int(outLen)
+		if err := z.flush(z.outBuf[:nOut]); err != nil {
+			return err
+		}
+		if outLen != 0 { // outbuf didn't fillup, i.e., the flush is complete.
+			return nil
+		}
+	}
+}
+
+// SetParams changes the compression level and strategy. The data written so
+// far is compressed with the old parameters and flushed to the output with
+// Z_BLOCK, as in FlushBlock. The new parameters apply to the data written
+// afterwards. Level and strategy have the same meaning as in Opts. Opts.Tune is
+// applied on top of the new level. Reset without options keeps the new
+// parameters.
+func (z *Writer) SetParams(level, strategy int) error {
+	// deflateParams flushes only if the strategy or the compression function
+	// changes, e.g., not from level 7 to 8, so flush here.
+	if err := z.deflateFlush(C.Z_BLOCK); err != nil {
+		return err
+	}
+	for {
+		outLen := C.int(len(z.outBuf))
+		start := time.Now()
+		ret := C.zs_deflate_params(&z.zs[0], C.int(level), C.int(strategy), unsafe.Pointer(&z.outBuf[0]), &outLen)
+		z.cgoTime += time.Since(start)
+		nOut := len(z.outBuf) - int(outLen)
+		if err := z.flush(z.outBuf[:nOut]); err != nil {
+			return err
+		}
+		// Z_BUF_ERROR means outBuf filled up before the flush completed.
+		if ret == C.Z_BUF_ERROR && nOut > 0 {
+			continue
+		}
+		if ret != C.Z_OK {
+			return zlibReturnCodeToError(ret)
+		}
+		z.opt.Level, z.opt.Strategy = level, strategy
+		if err := z.tune(); err != nil {
+			return err
+		}
+		if outLen == 0 {
+			// deflateParams doesn't check if the flushed block is still pending.
+			return z.deflateFlush(C.Z_BLOCK)
+		}
+		return nil
+	}
+}
+
 func freeGzHeaderFields(h *C.zng_gz_header) {
 	if h.comment != nil {
 		C.free(unsafe.Pointer(h.comment))
@@ -254,14 +883,30 @@ func freeGzHeaderFields(h *C.zng_gz_header) {
 	if h.name != nil {
 		C.free(unsafe.Pointer(h.name))
 	}
+	*h = C.zng_gz_header{}
 }
 
-// Close implements io.Closer
+// Close implements io.Closer. It finishes the stream and frees the deflate
+// state.
 func (z *Writer) Close() error {
+	err := z.Finish()
+	z.free()
+	return err
+}
+
+// Finish writes the rest of the stream, as Close does, but it keeps the deflate
+// state, so that the next Reset reuses it instead of allocating a new one. It
+// is meant for pools of writers that compress many short streams. The state is
+// freed by Close, by a Reset that changes the deflateInit2 parameters, or when
+// the writer is garbage collected. Nothing can be written after Finish until
+// Reset is called.
+func (z *Writer) Finish() error {
 	defer freeGzHeaderFields(&z.gzHeader)
 	for {
 		outLen := C.int(len(z.outBuf))
-		ret := C.zs_deflate_end(&z.zs[0], unsafe.Pointer(&z.outBuf[0]), &outLen)
+		start := time.Now()
+		ret := C.zs_deflate_finish(&z.zs[0], unsafe.Pointer(&z.outBuf[0]), &outLen)
+		z.cgoTime += time.Since(start)
 		if ret != 0 && ret != C.Z_STREAM_END {
 			return zlibReturnCodeToError(ret)
 		}
@@ -277,6 +922,28 @@ func (z *Writer) Close() error {
 
 // Write implements io.Writer.
 func (z *Writer) Write(in []byte) (int, error) {
+	if z.ctx == nil {
+		return z.write(in)
+	}
+	n := 0
+	for len(in) > 0 {
+		if err := z.ctx.Err(); err != nil {
+			return n, err
+		}
+		chunk := in
+		if len(chunk) > contextChunkSize {
+			chunk = chunk[:contextChunkSize]
+		}
+		if _, err := z.write(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		in = in[len(chunk):]
+	}
+	return n, nil
+}
+
+func (z *Writer) write(in []byte) (int, error) {
 	if len(in) == 0 {
 		return 0, nil
 	}
@@ -284,8 +951,10 @@ func (z *Writer) Write(in []byte) (int, error) {
 		outLen     = C.int(len(z.outBuf))
 		inConsumed C.int
 	)
+	start := time.Now()
 	ret := C.zs_deflate(&z.zs[0], unsafe.Pointer(&in[0]), C.int(len(in)),
 		unsafe.Pointer(&z.outBuf[0]), &outLen, &inConsumed)
+	z.cgoTime += time.Since(start)
 	if ret != 0 {
 		return 0, zlibReturnCodeToError(ret)
 	}
@@ -298,7 +967,9 @@ func (z *Writer) Write(in []byte) (int, error) {
 	}
 	for {
 		outLen = C.int(len(z.outBuf))
+		start = time.Now()
 		ret = C.zs_deflate(&z.zs[0], nil, 0, unsafe.Pointer(&z.outBuf[0]), &outLen, &inConsumed)
+		z.cgoTime += time.Since(start)
 		if ret != 0 {
 			return 0, zlibReturnCodeToError(ret)
 		}
@@ -313,15 +984,43 @@ func (z *Writer) Write(in []byte) (int, error) {
 	return len(in), nil
 }
 
+// ReadFrom implements io.ReaderFrom. It compresses the data read from r until
+// io.EOF. It does not close the writer. If r is a *bytes.Buffer, deflate reads
+// the buffer's contents without copying them to another Go buffer. Otherwise,
+// including when r is an *os.File, r reads into a buffer of Opts.Buffer bytes
+// that deflate consumes as is.
+func (z *Writer) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(z, r, &z.inBuf, z.opt.Buffer)
+}
+
+// Stats reports the progress of the writer. Compressed counts the bytes produced
+// by deflate, which are passed to the output right away. Data written since the
+// last flush may not be reflected in Compressed yet.
+func (z *Writer) Stats() Stats {
+	s := Stats{
+		Compressed:   int64(C.zs_get_total_out(&z.zs[0])),
+		Uncompressed: int64(C.zs_get_total_in(&z.zs[0])),
+		CgoTime:      z.cgoTime,
+	}
+	if s.Compressed > 0 {
+		s.Members = 1
+	}
+	if z.opt.WindowBits >= 0 {
+		s.Checksum = uint32(C.zs_get_adler(&z.zs[0]))
+	}
+	return s
+}
+
 var zlibErrors = map[C.int]error{
 	C.Z_OK:            nil,
 	C.Z_STREAM_END:    io.EOF,
+	C.Z_NEED_DICT:     ErrNeedDict,
 	C.Z_ERRNO:         nil, // handled separately
-	C.Z_STREAM_ERROR:  errors.New("Zlib: stream error"),
-	C.Z_DATA_ERROR:    errors.New("Zlib: data error"),
-	C.Z_MEM_ERROR:     errors.New("Zlib: mem error"),
-	C.Z_BUF_ERROR:     errors.New("Zlib: buf error"),
-	C.Z_VERSION_ERROR: errors.New("Zlib: version error"),
+	C.Z_STREAM_ERROR:  ErrStreamError,
+	C.Z_DATA_ERROR:    ErrDataError,
+	C.Z_MEM_ERROR:     ErrMemError,
+	C.Z_BUF_ERROR:     ErrBufError,
+	C.Z_VERSION_ERROR: ErrVersionError,
 }
 
 func zlibReturnCodeToError(r C.int) error {
@@ -336,3 +1035,46 @@ func zlibReturnCodeToError(r C.int) error {
 	}
 	return fmt.Errorf("Zlib: unknown error %d", r)
 }
+
+// streamReturnCodeToError is similar to zlibReturnCodeToError, but it reports a
+// *MemoryLimitError if r is Z_MEM_ERROR caused by the limit set by
+// SetMemoryLimit.
+func streamReturnCodeToError(zs *zstream, r C.int) error {
+	err := zlibReturnCodeToError(r)
+	if r == C.Z_MEM_ERROR && C.zs_take_mem_limit_exceeded(&zs[0]) != 0 {
+		err = &MemoryLimitError{Limit: memoryLimit(), InUse: MemoryInUse()}
+	}
+	return err
+}
+
+// newStreamError converts return code r of an inflate call to a *StreamError.
+// inBase and outBase are added to total_in and total_out of zs, respectively.
+func newStreamError(zs *zstream, r C.int, inBase, outBase int64, member int) error {
+	err := streamReturnCodeToError(zs, r)
+	if err == nil || r == C.Z_ERRNO {
+		return err
+	}
+	e := &StreamError{
+		Err:    err,
+		In:     inBase + int64(C.zs_get_total_in(&zs[0])),
+		Out:    outBase + int64(C.zs_get_total_out(&zs[0])),
+		Member: member,
+	}
+	if msg := C.zs_get_msg(&zs[0]); msg != nil && r != C.Z_NEED_DICT {
+		e.Msg = C.GoString(msg)
+	}
+	if r == C.Z_DATA_ERROR && (e.Msg == "incorrect data check" || e.Msg == "incorrect length check") {
+		e.Err = ErrChecksum
+	}
+	return e
+}
+
+// newTruncatedError reports that the input ended in the middle of a stream.
+func newTruncatedError(zs *zstream, inBase, outBase int64, member int) error {
+	return &StreamError{
+		Err:    io.ErrUnexpectedEOF,
+		In:     inBase + int64(C.zs_get_total_in(&zs[0])),
+		Out:    outBase + int64(C.zs_get_total_out(&zs[0])),
+		Member: member,
+	}
+}
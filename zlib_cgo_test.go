@@ -4,45 +4,373 @@ package zlibng_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/grailbio/testutil/assert"
-	"github.com/klauspost/compress/gzip"
 	"github.com/yasushi-saito/zlibng"
 )
 
-func TestDeflateHeader(t *testing.T) {
+func TestDeflateFlushFull(t *testing.T) {
 	out := bytes.Buffer{}
-	zout, err := zlibng.NewWriter(&out)
+	zout, err := zlibng.NewWriter(&out, zlibng.Opts{WindowBits: zlibng.Flate, Level: -1})
+	assert.NoError(t, err)
+	data := []byte("Hello, world. Hello, world.")
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.FlushFull())
+	n := out.Len()
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	// The data after a full flush must be decodable on its own.
+	zin, err := zlibng.NewReader(bytes.NewReader(out.Bytes()[n:]), zlibng.Opts{WindowBits: zlibng.Flate})
+	assert.NoError(t, err)
+	got := bytes.Buffer{}
+	_, err = io.Copy(&got, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got.String(), string(data))
+}
+
+func TestSetParams(t *testing.T) {
+	text := bytes.Repeat([]byte("hello, world. "), 100000)
+	r := rand.New(rand.NewSource(0))
+	random := make([]byte, len(text))
+	_, _ = r.Read(random)
+
+	// A small buffer makes deflateParams run out of output space.
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{Level: 0, Buffer: 256})
+	assert.NoError(t, err)
+	_, err = zout.Write(text)
+	assert.NoError(t, err)
+	stored := compressed.Len()
+	assert.NoError(t, zout.SetParams(9, zlibng.DefaultStrategy))
+	assert.True(t, compressed.Len() > len(text), "len=%d, stored=%d", compressed.Len(), stored)
+	n := compressed.Len()
+	_, err = zout.Write(text)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetParams(1, zlibng.HuffmanOnlyStrategy))
+	assert.True(t, compressed.Len()-n < len(text)/100, "len=%d", compressed.Len()-n)
+	_, err = zout.Write(random)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetParams(-1, zlibng.RLEStrategy))
+	_, err = zout.Write(text)
+	assert.NoError(t, err)
+	assert.Regexp(t, zout.SetParams(10, zlibng.DefaultStrategy), "stream error")
+	assert.NoError(t, zout.Close())
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+	want := append(append(append(append([]byte{}, text...), text...), random...), text...)
+	assert.True(t, bytes.Equal(got, want))
+
+	// The data is flushed even if the compression function stays the same.
+	compressed.Reset()
+	zout, err = zlibng.NewWriter(&compressed, zlibng.Opts{Level: 7})
+	assert.NoError(t, err)
+	_, err = zout.Write(text)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetParams(8, zlibng.DefaultStrategy))
+	zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	// Z_BLOCK may hold back the last few bits, i.e., the last match.
+	got = make([]byte, len(text))
+	n, _ = io.ReadFull(zin, got)
+	assert.True(t, n >= len(text)-258, "n=%d", n)
+	assert.True(t, bytes.Equal(got[:n], text[:n]))
+	assert.NoError(t, zout.Close())
+}
+
+func TestTune(t *testing.T) {
+	// Random DNA with repeats has long hash chains.
+	r := rand.New(rand.NewSource(0))
+	unit := make([]byte, 10000)
+	for i := range unit {
+		unit[i] = "ACGT"[r.Intn(4)]
+	}
+	var data []byte
+	for len(data) < 1<<20 {
+		start := r.Intn(len(unit) - 100)
+		data = append(data, unit[start:start+100+r.Intn(len(unit)-start-100)]...)
+	}
+	compress := func(opt zlibng.Opts) []byte {
+		compressed := bytes.Buffer{}
+		zout, err := zlibng.NewWriter(&compressed, opt)
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		got, err := zlibng.Uncompress(nil, compressed.Bytes())
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+		return compressed.Bytes()
+	}
+	plain := compress(zlibng.Opts{Level: 4})
+	tuned := compress(zlibng.Opts{Level: 4, Tune: zlibng.Tune{MaxChain: 4096, NiceLength: 258}})
+	assert.True(t, len(tuned) < len(plain), "tuned=%d, plain=%d", len(tuned), len(plain))
+
+	_, err := zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Level: 4, Tune: zlibng.Tune{NiceLength: 259}})
+	assert.Regexp(t, err, "invalid Tune")
+}
+
+func TestStatsCgoTime(t *testing.T) {
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed)
+	assert.NoError(t, err)
+	_, err = zout.Write(bytes.Repeat([]byte("hello, world. "), 100000))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.True(t, zout.Stats().CgoTime > 0)
+
+	zin, err := zlibng.NewReader(&compressed)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, zin.Stats().CgoTime > 0)
+	assert.NoError(t, zin.Close())
+	assert.NoError(t, zin.Reset(bytes.NewReader(nil)))
+	assert.EQ(t, zin.Stats().CgoTime, time.Duration(0))
+	_ = zin.Close()
+}
+
+func TestIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	// Mildly compressible data, so that there are many deflate blocks.
+	data := make([]byte, 4<<20)
+	for i := range data {
+		data[i] = byte('a' + r.Intn(8))
+	}
+	var compressed bytes.Buffer
+	zw, err := zlibng.NewWriter(&compressed)
+	assert.NoError(t, err)
+	_, err = zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	idx, err := zlibng.BuildIndex(bytes.NewReader(compressed.Bytes()), 256<<10)
+	assert.NoError(t, err)
+	assert.EQ(t, idx.Size, int64(len(data)))
+	assert.True(t, idx.NumPoints() > 4)
+
+	// Round trip the index through its serialized form.
+	var serialized bytes.Buffer
+	n, err := idx.WriteTo(&serialized)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(serialized.Len()))
+	idx, err = zlibng.ReadIndex(bytes.NewReader(serialized.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, idx.Size, int64(len(data)))
+
+	ra, err := zlibng.NewReaderAt(bytes.NewReader(compressed.Bytes()), idx)
 	assert.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		off := r.Intn(len(data))
+		buf := make([]byte, r.Intn(100000)+1)
+		n, err := ra.ReadAt(buf, int64(off))
+		if off+len(buf) > len(data) {
+			assert.EQ(t, err, io.EOF)
+			assert.EQ(t, n, len(data)-off)
+		} else {
+			assert.NoError(t, err)
+			assert.EQ(t, n, len(buf))
+		}
+		assert.True(t, bytes.Equal(buf[:n], data[off:off+n]), "off=%d", off)
+	}
+	_, err = ra.ReadAt(make([]byte, 1), int64(len(data)))
+	assert.EQ(t, err, io.EOF)
+
+	// Corrupt the checksum.
+	b := serialized.Bytes()
+	b[len(b)-1] ^= 1
+	_, err = zlibng.ReadIndex(bytes.NewReader(b))
+	assert.Regexp(t, err, "checksum mismatch")
+}
 
-	now := time.Unix(time.Now().Unix(), 0)
-	wantHeader := zlibng.GzipHeader{Comment: "hello", Name: "blah", Extra: []byte{3, 2, 1}, ModTime: now, OS: 11}
-	assert.NoError(t, zout.SetHeader(wantHeader))
-	data := []byte("testdata")
-	n, err := zout.Write(data)
+func TestStreamErrorMessage(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 10000)
+	compressed, err := zlibng.Compress(nil, data, 5, zlibng.Zlib)
 	assert.NoError(t, err)
-	assert.EQ(t, n, len(data))
+	compressed[len(compressed)-1] ^= 1
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	var se *zlibng.StreamError
+	assert.True(t, errors.As(err, &se))
+	assert.EQ(t, se.Err, zlibng.ErrChecksum)
+	assert.EQ(t, se.Msg, "incorrect data check")
+	assert.EQ(t, se.Out, int64(len(data)))
+	assert.EQ(t, se.In, int64(len(compressed)))
+	assert.Regexp(t, err.Error(), "incorrect data check")
+}
+
+func TestWindowSize(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 1000)
+	for _, format := range []zlibng.Format{zlibng.FormatGzip, zlibng.FormatZlib, zlibng.FormatRaw} {
+		compressed := bytes.Buffer{}
+		zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{Format: format, WindowSize: 9, Level: -1})
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		for _, opts := range []zlibng.Opts{
+			{Format: format, WindowSize: 9},
+			{Format: format},
+			{Format: zlibng.FormatAuto},
+		} {
+			zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), opts)
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(zin)
+			assert.NoError(t, err, "format=%d opts=%+v", format, opts)
+			assert.NoError(t, zin.Close())
+			assert.EQ(t, string(got), string(data))
+		}
+	}
+
+	// A zlib stream records its window size, which must fit in the reader's.
+	compressed, err := zlibng.Compress(nil, bytes.Repeat([]byte("hello, world. "), 1000), 5, zlibng.Zlib)
+	assert.NoError(t, err)
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed), zlibng.Opts{Format: zlibng.FormatZlib, WindowSize: 9})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.Regexp(t, err, "invalid window size")
+}
+
+func TestMemoryLimit(t *testing.T) {
+	// Readers left open by other tests may be finalized at any time, so the
+	// total is only compared with the memory of the streams created here.
+	zout, err := zlibng.NewWriter(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.True(t, zout.MemoryInUse() > 0)
+	assert.True(t, zlibng.MemoryInUse() >= zout.MemoryInUse())
 	assert.NoError(t, zout.Close())
-	{
-		zin, err := zlibng.NewReader(bytes.NewReader(out.Bytes()))
+	assert.EQ(t, zout.MemoryInUse(), int64(0))
+
+	compressed, err := zlibng.Compress(nil, bytes.Repeat([]byte("hello, world. "), 10000), 5, zlibng.Gzip)
+	assert.NoError(t, err)
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed))
+	assert.NoError(t, err)
+	stateSize := zin.MemoryInUse()
+	assert.True(t, stateSize > 0)
+
+	// The inflate window is allocated by Read once the output exceeds the buffer
+	// passed to Read. It is larger than 1KiB.
+	limit := zlibng.MemoryInUse() + 1024
+	old := zlibng.SetMemoryLimit(limit)
+	defer zlibng.SetMemoryLimit(old)
+	_, err = ioutil.ReadAll(zin)
+	var limitErr *zlibng.MemoryLimitError
+	assert.True(t, errors.As(err, &limitErr), "err=%v", err)
+	assert.EQ(t, limitErr.Limit, limit)
+	assert.True(t, errors.Is(err, zlibng.ErrMemError))
+	assert.True(t, zin.MemoryInUse() >= stateSize)
+	_ = zin.Close()
+	assert.EQ(t, zin.MemoryInUse(), int64(0))
+
+	_, err = zlibng.NewWriter(ioutil.Discard)
+	assert.True(t, errors.As(err, &limitErr), "err=%v", err)
+
+	zlibng.SetMemoryLimit(0)
+	zout, err = zlibng.NewWriter(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+}
+
+func TestWriterFinish(t *testing.T) {
+	var out bytes.Buffer
+	zout, err := zlibng.NewWriter(&out)
+	assert.NoError(t, err)
+	stateSize := zout.MemoryInUse()
+	check := func(data string) {
+		zin, err := gzip.NewReader(&out)
 		assert.NoError(t, err)
-		got := bytes.Buffer{}
-		_, err = io.Copy(&got, zin)
+		got, err := ioutil.ReadAll(zin)
 		assert.NoError(t, err)
-		assert.EQ(t, string(got.Bytes()), string(data))
-		gotHeader, err := zin.Header()
+		assert.EQ(t, string(got), data)
+	}
+	// Finish keeps the deflate state and Reset reuses it, so the writer doesn't
+	// need to allocate any more memory.
+	old := zlibng.SetMemoryLimit(zlibng.MemoryInUse() - 1)
+	for i := 0; i < 3; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		data := fmt.Sprintf("hello %d", i)
+		_, err = zout.Write([]byte(data))
 		assert.NoError(t, err)
-		assert.EQ(t, gotHeader, wantHeader)
+		assert.NoError(t, zout.Finish())
+		assert.EQ(t, zout.MemoryInUse(), stateSize)
+		check(data)
 	}
-	{
-		zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	zlibng.SetMemoryLimit(old)
+
+	// Close after Finish frees the state, and Reset allocates a new one.
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, zout.MemoryInUse(), int64(0))
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	assert.EQ(t, zout.MemoryInUse(), stateSize)
+	_, err = zout.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, zout.MemoryInUse(), int64(0))
+	check("hello")
+}
+
+func TestReaderHeaderMemory(t *testing.T) {
+	data := []byte("hello, world")
+	newReader := func(format int, opt zlibng.Opts) *zlibng.Reader {
+		compressed, err := zlibng.Compress(nil, data, 5, format)
 		assert.NoError(t, err)
-		got := bytes.Buffer{}
-		_, err = io.Copy(&got, zin)
+		zin, err := zlibng.NewReader(bytes.NewReader(compressed), opt)
+		assert.NoError(t, err)
+		return zin
+	}
+	// The header buffers start small, and they grow only for long fields.
+	zin := newReader(zlibng.Gzip, zlibng.Opts{})
+	small := zin.MemoryInUse()
+	assert.True(t, small < zlibng.DefaultMaxHeaderField, "size=%d", small)
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetHeader(zlibng.GzipHeader{Name: strings.Repeat("n", 20000)}))
+	assert.NoError(t, zout.Close())
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed.Bytes())))
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	h, err := zin.Header()
+	assert.NoError(t, err)
+	assert.EQ(t, len(h.Name), 20000)
+	assert.True(t, zin.MemoryInUse() > small+3*20000, "size=%d", zin.MemoryInUse())
+
+	// Only the readers of gzip streams keep the header buffers.
+	assert.NoError(t, zin.Reset(bytes.NewReader(nil), zlibng.Opts{WindowBits: zlibng.Flate}))
+	assert.True(t, zin.MemoryInUse() < zlibng.DefaultMaxHeaderField, "size=%d", zin.MemoryInUse())
+	assert.NoError(t, zin.Close())
+	assert.EQ(t, zin.MemoryInUse(), int64(0))
+
+	for _, format := range []int{zlibng.Zlib, zlibng.Flate} {
+		zin = newReader(format, zlibng.Opts{WindowBits: format})
+		assert.True(t, zin.MemoryInUse() < zlibng.DefaultMaxHeaderField, "format=%d size=%d", format, zin.MemoryInUse())
+		got, err := ioutil.ReadAll(zin)
 		assert.NoError(t, err)
-		assert.EQ(t, string(got.Bytes()), string(data))
+		assert.EQ(t, string(got), string(data))
+		assert.NoError(t, zin.Close())
 	}
+
+	zin = newReader(zlibng.Gzip, zlibng.Opts{MaxHeaderField: 10})
+	assert.True(t, zin.MemoryInUse() < zlibng.DefaultMaxHeaderField, "size=%d", zin.MemoryInUse())
+	assert.NoError(t, zin.Close())
 }
@@ -3,52 +3,702 @@
 package zlibng
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
 	"io"
 
 	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
 )
 
-type reader struct {
-	io.ReadCloser
+// Reader is a gzip/zlib/flate reader. It implements io.ReadCloser. This
+// pure-Go implementation is based on klauspost/compress. It has the same API as
+// the cgo implementation, but some of the features are not supported.
+type Reader struct {
+	zr     io.ReadCloser // *gzip.Reader, or the zlib or flate reader.
+	format int           // Gzip, Zlib, or Flate.
+	opt    Opts
+	// in is the input of the decompressor. The gzip reader is always in
+	// single-member mode, and it doesn't read beyond the end of the current
+	// member. The next member is started by resetting the gzip reader to in.
+	in          *bufio.Reader
+	src         *countingReader // the source of in.
+	multistream bool
+	member      int             // index of the current gzip member.
+	out         int64           // # of bytes read so far.
+	err         error           // error returned by the last Read.
+	ctx         context.Context // see NewReaderContext. May be nil.
+	outBuf      []byte          // output buffer of WriteTo. Allocated on demand.
+	sum         hash.Hash32     // checksum of the current member. Nil for Flate.
 }
 
-// NewReader creates a gzip/flate writer. There can be at most one options arg.
-func NewReader(in io.Reader, opts ...Opts) (reader, error) {
+// NewReader creates a gzip/zlib/flate reader. There can be at most one options
+// arg. If Opts.WindowBits is unset, the reader detects gzip or zlib from the
+// stream header.
+func NewReader(in io.Reader, opts ...Opts) (*Reader, error) {
 	opt, err := getOpts(opts...)
 	if err != nil {
-		return reader{}, err
+		return nil, err
 	}
-	if opt.WindowBits == Flate {
-		z := flate.NewReader(in)
-		return reader{z}, nil
+	r := &Reader{}
+	if err := r.init(in, opt); err != nil {
+		return nil, err
 	}
-	z, err := gzip.NewReader(in)
-	return reader{z}, err
+	return r, nil
 }
 
-func (r reader) Header() (GzipHeader, error) {
-	return GzipHeader{}, errors.New("zlibng.Header: Not supported")
+// NewReaderContext is similar to NewReader, but Read checks ctx between inflate
+// chunks, and it returns ctx.Err() once ctx is done. The reader keeps using ctx
+// after Reset.
+func NewReaderContext(ctx context.Context, in io.Reader, opts ...Opts) (*Reader, error) {
+	r, err := NewReader(in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ctx = ctx
+	return r, nil
+}
+
+// Reset makes the reader read from in. The decompressor is reused if the format
+// doesn't change.
+func (r *Reader) Reset(in io.Reader, opts ...Opts) error {
+	opt := r.opt
+	if len(opts) > 0 {
+		var err error
+		if opt, err = getOpts(opts...); err != nil {
+			return err
+		}
+	}
+	return r.init(in, opt)
+}
+
+// autoFormat is returned by readerFormat if the reader must detect gzip or zlib
+// from the stream header.
+const autoFormat = 32 + 15
+
+// readerFormat returns the format, one of Gzip, Zlib, Flate, or autoFormat,
+// that the reader uses for windowBits. klauspost/compress always uses 32KiB
+// windows, so it can read streams with any window size.
+func readerFormat(windowBits int) (int, error) {
+	switch {
+	case windowBits == 0 || (windowBits >= 32+8 && windowBits <= 32+15):
+		return autoFormat, nil
+	case windowBits >= 16+8 && windowBits <= Gzip:
+		return Gzip, nil
+	case windowBits >= 8 && windowBits <= Zlib:
+		return Zlib, nil
+	case windowBits >= Flate && windowBits <= -8:
+		return Flate, nil
+	}
+	return 0, fmt.Errorf("zlibng.NewReader: invalid WindowBits %d", windowBits)
+}
+
+// init makes the reader read from in using opt. On error, the reader is left
+// unusable until the next Reset.
+func (r *Reader) init(in io.Reader, opt Opts) error {
+	if opt.Format == FormatAuto {
+		var err error
+		if in, opt.WindowBits, err = sniffFormat(in, opt.WindowSize); err != nil {
+			return err
+		}
+	}
+	format, err := readerFormat(opt.WindowBits)
+	if err != nil {
+		return err
+	}
+	if format == Gzip && opt.Format != FormatAuto && (len(opt.Dictionary) > 0 || opt.DictionaryFunc != nil) {
+		return errors.New("zlibng.NewReader: Dictionary cannot be used with the Gzip format")
+	}
+	r.opt = opt
+	r.multistream = true
+	r.member = 0
+	r.out = 0
+	r.err = nil
+	r.sum = nil
+	r.src = &countingReader{r: in}
+	r.in = bufio.NewReader(r.src)
+	if format == Flate {
+		if r.format == Flate {
+			r.err = r.zr.(flate.Resetter).Reset(r.in, opt.Dictionary)
+		} else {
+			r.format, r.zr = Flate, flate.NewReaderDict(r.in, opt.Dictionary)
+		}
+		return r.err
+	}
+	if format == autoFormat {
+		format = Zlib
+		if b, err := r.in.Peek(2); err == nil && b[0] == 0x1f && b[1] == 0x8b {
+			format = Gzip
+		}
+	}
+	if format == Gzip {
+		z, ok := r.zr.(*gzip.Reader)
+		if !ok {
+			z = new(gzip.Reader)
+		}
+		r.format, r.zr, r.sum = Gzip, z, crc32.NewIEEE()
+		if err := z.Reset(r.in); err != nil {
+			r.err = convertError(noEOF(err), 0, 0)
+			return r.err
+		}
+		z.Multistream(false)
+		return nil
+	}
+	r.sum = adler32.New()
+	dict, err := r.zlibDictionary()
+	if err == nil {
+		if r.format == Zlib {
+			err = r.zr.(zlib.Resetter).Reset(r.in, dict)
+		} else {
+			r.format = Zlib
+			r.zr, err = zlib.NewReaderDict(r.in, dict)
+		}
+	}
+	if err != nil {
+		// Drop the zlib reader. It may still point to the previous stream.
+		r.format, r.zr = 0, nil
+		r.err = convertError(noEOF(err), 0, 0)
+	}
+	return r.err
+}
+
+// zlibDictionary returns the preset dictionary for the zlib stream in r.in. The
+// zlib reader needs the dictionary before reading the stream header, so this
+// function peeks at the header.
+func (r *Reader) zlibDictionary() ([]byte, error) {
+	b, err := r.in.Peek(6)
+	if err != nil || b[1]&0x20 == 0 {
+		// Errors in the header are reported by the zlib reader.
+		return r.opt.Dictionary, nil
+	}
+	if r.opt.DictionaryFunc != nil {
+		return r.opt.DictionaryFunc(binary.BigEndian.Uint32(b[2:]))
+	}
+	if len(r.opt.Dictionary) == 0 {
+		return nil, ErrNeedDict
+	}
+	return r.opt.Dictionary, nil
+}
+
+// Multistream controls whether the reader supports multi-member gzip files.
+// See the cgo implementation for details.
+func (r *Reader) Multistream(ok bool) {
+	r.multistream = ok
+}
+
+// NextMember advances to the next member of a multi-member gzip or zlib file.
+// The rest of the current member, if any, is discarded. It returns io.EOF if
+// there are no more members.
+func (r *Reader) NextMember() error {
+	if r.format == Flate {
+		return errors.New("zlibng.NextMember: raw flate streams have no members")
+	}
+	if r.zr == nil {
+		return r.err
+	}
+	// Don't use io.Copy. gzip.Reader.WriteTo miscomputes the checksum if the
+	// member has been partially read.
+	var buf [4096]byte
+	for {
+		n, err := r.zr.Read(buf[:])
+		r.account(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return convertError(err, r.out, r.member)
+		}
+	}
+	return r.nextMember()
+}
+
+// nextMember starts reading the next gzip or zlib member. It returns io.EOF if
+// there are no more members.
+func (r *Reader) nextMember() error {
+	// Check for the end of the input before Reset, which would clear the header
+	// of the current member.
+	if _, err := r.in.Peek(1); err != nil {
+		return err
+	}
+	if err := checkMaxMembers(r.opt, r.consumed(), r.out, r.member+1); err != nil {
+		return err
+	}
+	var err error
+	if z, ok := r.zr.(*gzip.Reader); ok {
+		if err = z.Reset(r.in); err == nil {
+			z.Multistream(false)
+		}
+	} else {
+		var dict []byte
+		if dict, err = r.zlibDictionary(); err == nil {
+			err = r.zr.(zlib.Resetter).Reset(r.in, dict)
+		}
+	}
+	if err != nil {
+		return convertError(noEOF(err), r.out, r.member+1)
+	}
+	r.member++
+	r.sum.Reset()
+	return nil
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.zr == nil {
+		return 0, r.err
+	}
+	for {
+		if r.ctx != nil {
+			if err := r.ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		// Inflate at most one byte more than the limits allow, to detect the
+		// crossing. Fill the input buffer first, so that MaxRatio doesn't count
+		// only the bytes consumed so far.
+		if r.opt.MaxRatio > 0 && r.in.Buffered() == 0 {
+			_, _ = r.in.Peek(1)
+		}
+		buf := p
+		if r.ctx != nil && len(buf) > contextChunkSize {
+			buf = buf[:contextChunkSize]
+		}
+		allowed, limited := outputAllowance(r.opt, r.src.n, r.out)
+		if limited && int64(len(buf)) > allowed {
+			buf = buf[:allowed+1]
+		}
+		n, err := r.zr.Read(buf)
+		if limited && int64(n) > allowed {
+			r.account(buf[:allowed])
+			r.err = newOutputLimitError(r.opt, r.consumed(), r.out, r.member)
+			return int(allowed), r.err
+		}
+		r.account(buf[:n])
+		if err == io.EOF && r.multistream && r.format != Flate {
+			err = r.nextMember()
+			if err == nil && n == 0 {
+				continue
+			}
+		}
+		r.err = convertError(err, r.out, r.member)
+		return n, r.err
+	}
+}
+
+// account records that the decompressor produced p.
+func (r *Reader) account(p []byte) {
+	r.out += int64(len(p))
+	if r.sum != nil {
+		_, _ = r.sum.Write(p)
+	}
+}
+
+// Stats reports the progress of the reader. CgoTime is always zero. The
+// checksum is computed by the reader itself, since klauspost/compress doesn't
+// expose it. When a member ends, the reader starts the next one right away, so
+// Checksum is reset sooner than in the cgo implementation.
+func (r *Reader) Stats() Stats {
+	s := Stats{Uncompressed: r.out}
+	if r.src != nil {
+		s.Compressed = r.consumed()
+	}
+	if r.zr != nil {
+		s.Members = r.member + 1
+	}
+	if r.sum != nil {
+		s.Checksum = r.sum.Sum32()
+	}
+	return s
+}
+
+// WriteTo implements io.WriterTo. It decompresses the rest of the stream into
+// w. If w is a *bytes.Buffer, Read fills the buffer's unused capacity.
+// Otherwise, Read fills a buffer of Opts.Buffer bytes that is passed to w.Write.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(r, w, &r.outBuf, r.opt.Buffer)
+}
+
+// Close implements io.Closer. It reports the error returned by the last Read,
+// if any.
+func (r *Reader) Close() error {
+	if r.zr == nil {
+		return r.err
+	}
+	err := r.zr.Close()
+	if r.err != nil && r.err != io.EOF {
+		return r.err
+	}
+	return err
+}
+
+// consumed returns the number of compressed bytes consumed by the
+// decompressor. The decompressors read r.in byte by byte, so they don't consume
+// the buffered bytes.
+func (r *Reader) consumed() int64 {
+	return r.src.n - int64(r.in.Buffered())
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF. The gzip reader reports
+// io.EOF for an empty input, which is not a valid gzip file.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// convertError converts an error reported by klauspost/compress to a
+// *StreamError. The compressed offset is unknown.
+func convertError(err error, out int64, member int) error {
+	e := &StreamError{In: -1, Out: out, Member: member}
+	switch err {
+	case io.ErrUnexpectedEOF, ErrNeedDict:
+		e.Err = err
+	case gzip.ErrChecksum, zlib.ErrChecksum:
+		e.Err, e.Msg = ErrChecksum, "incorrect data check"
+	case gzip.ErrHeader, zlib.ErrHeader:
+		e.Err, e.Msg = ErrDataError, "incorrect header check"
+	case zlib.ErrDictionary:
+		e.Err, e.Msg = ErrDataError, "invalid dictionary"
+	default:
+		ce, ok := err.(flate.CorruptInputError)
+		if !ok {
+			return err
+		}
+		e.Err, e.Msg = ErrDataError, ce.Error()
+	}
+	return e
 }
 
-type writer struct{ io.WriteCloser }
+// Header reads the gzip header contents. If the file is a multi-gzip
+// concatenation, this function returns the contents of the current member.
+// Unlike the cgo implementation, names and comments longer than 511 bytes
+// are reported as a data error when the member is opened.
+func (r *Reader) Header() (GzipHeader, error) {
+	z, ok := r.zr.(*gzip.Reader)
+	if !ok {
+		return GzipHeader{}, errors.New("zlibng.header: Header not supported")
+	}
+	h := GzipHeader{
+		Comment: z.Comment,
+		Extra:   z.Extra,
+		ModTime: z.ModTime,
+		Name:    z.Name,
+		OS:      z.OS,
+	}
+	// Apply the same limit as the cgo implementation.
+	max := r.opt.MaxHeaderField
+	if len(h.Comment) > max {
+		h.Comment, h.Truncated = h.Comment[:max], true
+	}
+	if len(h.Extra) > max {
+		h.Extra, h.Truncated = h.Extra[:max], true
+	}
+	if len(h.Name) > max {
+		h.Name, h.Truncated = h.Name[:max], true
+	}
+	return h, nil
+}
+
+// Writer is a gzip/zlib/flate writer. It implements io.WriteCloser. This
+// pure-Go implementation is based on klauspost/compress.
+type Writer struct {
+	zw    io.WriteCloser // *gzip.Writer, *zlib.Writer, or *flate.Writer.
+	opt   Opts
+	ctx   context.Context // see NewWriterContext. May be nil.
+	inBuf []byte          // input buffer of ReadFrom. Allocated on demand.
+	dst   countingWriter  // the output of zw.
+	in    int64           // # of bytes written so far.
+	sum   hash.Hash32     // checksum of the data written so far. Nil for Flate.
+}
 
-// NewWriter creates a gzip/flate writer. There can be at most one options arg.
-// If opts is empty, NewWriter will use Opts{Format:Gzip,Level:-1}.
-func NewWriter(w io.Writer, opts ...Opts) (writer, error) {
+// NewWriter creates a gzip/zlib/flate writer. There can be at most one options
+// arg. If opts is empty, NewWriter will use Opts{Format:Gzip,Level:-1}.
+//
+// klauspost/compress always uses 32KiB windows and supports only
+// DefaultStrategy and HuffmanOnlyStrategy, so NewWriter returns an error for
+// other values of Opts.WindowBits and Opts.Strategy. Opts.MemLevel is checked,
+// but otherwise ignored.
+func NewWriter(w io.Writer, opts ...Opts) (*Writer, error) {
 	opt, err := getOpts(opts...)
 	if err != nil {
-		return writer{}, err
+		return nil, err
+	}
+	z := &Writer{}
+	if err := z.init(w, opt); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// NewWriterContext is similar to NewWriter, but Write checks ctx between
+// deflate chunks, and it returns ctx.Err() once ctx is done. The writer keeps
+// using ctx after Reset.
+func NewWriterContext(ctx context.Context, w io.Writer, opts ...Opts) (*Writer, error) {
+	z, err := NewWriter(w, opts...)
+	if err != nil {
+		return nil, err
+	}
+	z.ctx = ctx
+	return z, nil
+}
+
+// Reset makes the writer write to w. The compressor is reused if the format,
+// level, and dictionary don't change.
+func (w *Writer) Reset(out io.Writer, opts ...Opts) error {
+	opt := w.opt
+	if len(opts) > 0 {
+		var err error
+		if opt, err = getOpts(opts...); err != nil {
+			return err
+		}
+	}
+	return w.init(out, opt)
+}
+
+// writerFormat returns the format, one of Gzip, Zlib, or Flate, that the writer
+// uses for windowBits.
+func writerFormat(windowBits int) (int, error) {
+	switch windowBits {
+	case 0:
+		return Gzip, nil
+	case Gzip, Zlib, Flate:
+		return windowBits, nil
+	}
+	return 0, fmt.Errorf("zlibng.NewWriter: WindowBits %d is not supported by the pure-Go implementation", windowBits)
+}
+
+// writerLevel returns the klauspost/compress compression level for opt.Level
+// and opt.Strategy.
+func writerLevel(opt Opts) (int, error) {
+	if opt.MemLevel < 0 || opt.MemLevel > 9 {
+		return 0, fmt.Errorf("zlibng.NewWriter: invalid MemLevel %d", opt.MemLevel)
+	}
+	switch opt.Strategy {
+	case DefaultStrategy:
+		return opt.Level, nil
+	case HuffmanOnlyStrategy:
+		if opt.Level == 0 {
+			// zlib stores the data uncompressed at level 0, regardless of the
+			// strategy.
+			return 0, nil
+		}
+		return flate.HuffmanOnly, nil
+	}
+	return 0, fmt.Errorf("zlibng.NewWriter: Strategy %d is not supported by the pure-Go implementation", opt.Strategy)
+}
+
+// init makes the writer write to out using opt.
+func (w *Writer) init(out io.Writer, opt Opts) error {
+	if opt.Format == FormatAuto {
+		return errAutoWriter
+	}
+	format, err := writerFormat(opt.WindowBits)
+	if err != nil {
+		return err
+	}
+	level, err := writerLevel(opt)
+	if err != nil {
+		return err
+	}
+	if format == Gzip && len(opt.Dictionary) > 0 {
+		return errors.New("zlibng.NewWriter: Dictionary cannot be used with the Gzip format")
+	}
+	if opt.Tune != (Tune{}) {
+		return errors.New("zlibng.NewWriter: Tune is not supported by the pure-Go implementation")
+	}
+	w.dst = countingWriter{w: out}
+	w.in = 0
+	switch format {
+	case Gzip:
+		w.sum = crc32.NewIEEE()
+	case Zlib:
+		w.sum = adler32.New()
+	default:
+		w.sum = nil
+	}
+	if w.zw != nil {
+		oldFormat, _ := writerFormat(w.opt.WindowBits)
+		oldLevel, _ := writerLevel(w.opt)
+		if format == oldFormat && level == oldLevel {
+			switch z := w.zw.(type) {
+			case *gzip.Writer:
+				w.opt = opt
+				z.Reset(&w.dst)
+				return nil
+			case *flate.Writer:
+				w.opt = opt
+				z.ResetDict(&w.dst, opt.Dictionary)
+				return nil
+			case *zlib.Writer:
+				// The zlib writer keeps the dictionary it was created with.
+				if bytes.Equal(opt.Dictionary, w.opt.Dictionary) {
+					w.opt = opt
+					z.Reset(&w.dst)
+					return nil
+				}
+			}
+		}
+	}
+	var z io.WriteCloser
+	switch format {
+	case Flate:
+		z, err = flate.NewWriterDict(&w.dst, level, opt.Dictionary)
+	case Zlib:
+		z, err = zlib.NewWriterLevelDict(&w.dst, level, opt.Dictionary)
+	default:
+		z, err = gzip.NewWriterLevel(&w.dst, level)
+	}
+	if err != nil {
+		return err
+	}
+	w.zw, w.opt = z, opt
+	return nil
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.ctx == nil {
+		n, err := w.zw.Write(p)
+		w.account(p[:n])
+		return n, err
+	}
+	n := 0
+	for len(p) > 0 {
+		if err := w.ctx.Err(); err != nil {
+			return n, err
+		}
+		chunk := p
+		if len(chunk) > contextChunkSize {
+			chunk = chunk[:contextChunkSize]
+		}
+		m, err := w.zw.Write(chunk)
+		w.account(chunk[:m])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// account records that the compressor consumed p.
+func (w *Writer) account(p []byte) {
+	w.in += int64(len(p))
+	if w.sum != nil {
+		_, _ = w.sum.Write(p)
 	}
-	if opt.WindowBits == Flate {
-		z, err := flate.NewWriter(w, opt.Level)
-		return writer{z}, err
+}
+
+// Stats reports the progress of the writer. CgoTime is always zero. Data
+// written since the last flush may not be reflected in Compressed yet.
+func (w *Writer) Stats() Stats {
+	s := Stats{Compressed: w.dst.n, Uncompressed: w.in}
+	if s.Compressed > 0 {
+		s.Members = 1
+	}
+	if w.sum != nil {
+		s.Checksum = w.sum.Sum32()
 	}
-	z, err := gzip.NewWriterLevel(w, opt.Level)
-	return writer{z}, err
+	return s
+}
+
+// ReadFrom implements io.ReaderFrom. It compresses the data read from r until
+// io.EOF. It does not close the writer. If r is a *bytes.Buffer, its contents are
+// passed to Write as is. Otherwise, r reads into a buffer of Opts.Buffer bytes.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(w, r, &w.inBuf, w.opt.Buffer)
 }
 
-func (w writer) SetHeader(GzipHeader) error {
-	return errors.New("zlibng.SetHeader: Not supported")
+// Close implements io.Closer.
+func (w *Writer) Close() error {
+	return w.zw.Close()
+}
+
+// abort drops the writer without finishing the stream.
+func (w *Writer) abort() {}
+
+// Finish is the same as Close. Reset reuses the compressor after Close, too.
+func (w *Writer) Finish() error {
+	return w.Close()
+}
+
+// SetHeader sets the Gzip header contents.
+//
+// REQUIRES: No Write nor Close has been called yet.
+// REQUIRES: The archive format is Gzip.
+func (w *Writer) SetHeader(h GzipHeader) error {
+	z, ok := w.zw.(*gzip.Writer)
+	if !ok {
+		return errors.New("zlibng.SetHeader: the format is not Gzip")
+	}
+	z.Header = gzip.Header{Comment: h.Comment, ModTime: h.ModTime, Name: h.Name, OS: 255}
+	if len(h.Extra) > 0 {
+		z.Extra = h.Extra
+	}
+	if h.OS != 0 {
+		z.OS = h.OS
+	}
+	return nil
+}
+
+// Flush writes the data written so far to the output, using the equivalent of
+// Z_SYNC_FLUSH.
+func (w *Writer) Flush() error {
+	return w.zw.(interface{ Flush() error }).Flush()
+}
+
+// FlushPartial is the same as Flush. The pure-Go implementation always does a
+// sync flush, which is a superset of a partial flush.
+func (w *Writer) FlushPartial() error {
+	return w.Flush()
+}
+
+// FlushFull is not supported by the pure-Go implementation.
+func (w *Writer) FlushFull() error {
+	return errors.New("zlibng.FlushFull: Not supported")
+}
+
+// FlushBlock is the same as Flush. The pure-Go implementation always does a
+// sync flush, which completes the current block.
+func (w *Writer) FlushBlock() error {
+	return w.Flush()
+}
+
+// SetParams is supported by the pure-Go implementation only if it doesn't
+// change the effective compression level. In that case it is the same as
+// Flush.
+func (w *Writer) SetParams(level, strategy int) error {
+	opt := w.opt
+	opt.Level, opt.Strategy = level, strategy
+	newLevel, err := writerLevel(opt)
+	if err != nil {
+		return err
+	}
+	if oldLevel, _ := writerLevel(w.opt); newLevel != oldLevel {
+		return errors.New("zlibng.SetParams: Not supported")
+	}
+	w.opt = opt
+	return w.Flush()
 }
@@ -0,0 +1,25 @@
+// +build !cgo
+
+package zlibng_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/yasushi-saito/zlibng"
+)
+
+func TestUnsupportedOpts(t *testing.T) {
+	_, err := zlibng.NewWriter(ioutil.Discard, zlibng.Opts{WindowBits: 9, Level: -1})
+	assert.Regexp(t, err, "WindowBits 9 is not supported")
+	_, err = zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Level: -1, Strategy: zlibng.RLEStrategy})
+	assert.Regexp(t, err, "Strategy 3 is not supported")
+	_, err = zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Level: -1, MemLevel: 10})
+	assert.Regexp(t, err, "invalid MemLevel")
+	_, err = zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Level: -1, Tune: zlibng.Tune{MaxChain: 1024}})
+	assert.Regexp(t, err, "Tune is not supported")
+	zout, err := zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Level: -1, MemLevel: 9})
+	assert.NoError(t, err)
+	assert.Regexp(t, zout.Reset(ioutil.Discard, zlibng.Opts{Level: -1, Strategy: zlibng.FixedStrategy}), "not supported")
+}
@@ -27,21 +27,57 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/adler32"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/grailbio/testutil/assert"
 	kgzip "github.com/klauspost/compress/gzip"
 	"github.com/yasushi-saito/zlibng"
 )
 
+// The cgo and pure-Go implementations must export the same API.
+var (
+	_ interface {
+		io.ReadCloser
+		Reset(in io.Reader, opts ...zlibng.Opts) error
+		Multistream(ok bool)
+		NextMember() error
+		Header() (zlibng.GzipHeader, error)
+		Stats() zlibng.Stats
+		MemoryInUse() int64
+		io.WriterTo
+	} = (*zlibng.Reader)(nil)
+	_ interface {
+		io.WriteCloser
+		Reset(w io.Writer, opts ...zlibng.Opts) error
+		SetHeader(h zlibng.GzipHeader) error
+		Flush() error
+		FlushPartial() error
+		FlushFull() error
+		FlushBlock() error
+		SetParams(level, strategy int) error
+		Finish() error
+		Stats() zlibng.Stats
+		MemoryInUse() int64
+		io.ReaderFrom
+	} = (*zlibng.Writer)(nil)
+)
+
 func testInflate(t *testing.T, r *rand.Rand, windowBits int, src []byte, want []byte) {
 	zin, err := zlibng.NewReader(bytes.NewReader(src), zlibng.Opts{WindowBits: windowBits})
 	assert.NoError(t, err)
@@ -210,6 +246,918 @@ func testDeflate(t *testing.T, r *rand.Rand, windowBits int, src []byte) {
 	}
 }
 
+func testFlush(t *testing.T, windowBits int, partial bool) {
+	out := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&out, zlibng.Opts{WindowBits: windowBits, Level: -1})
+	assert.NoError(t, err)
+	data := []byte("Hello, world. Hello, world.")
+	for i := 0; i < 3; i++ {
+		_, err := zout.Write(data)
+		assert.NoError(t, err)
+		if partial {
+			assert.NoError(t, zout.FlushPartial())
+		} else {
+			assert.NoError(t, zout.Flush())
+		}
+
+		// Everything written so far must be decodable without Close.
+		want := bytes.Repeat(data, i+1)
+		var zin io.Reader
+		if windowBits == zlibng.Gzip {
+			zin, err = gzip.NewReader(bytes.NewReader(out.Bytes()))
+			assert.NoError(t, err)
+		} else {
+			zin = flate.NewReader(bytes.NewReader(out.Bytes()))
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(zin, got)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), string(want))
+	}
+	assert.NoError(t, zout.Close())
+}
+
+func TestDeflateFlush(t *testing.T) {
+	for _, windowBits := range []int{zlibng.Gzip, zlibng.Flate} {
+		testFlush(t, windowBits, false)
+		testFlush(t, windowBits, true)
+	}
+}
+
+func TestFlateDictionary(t *testing.T) {
+	dict := []byte("hello, world. goodbye, world.")
+	data := []byte("hello, world. hello, world. goodbye, world.")
+
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{WindowBits: zlibng.Flate, Level: -1, Dictionary: dict})
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	got, err := ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(compressed.Bytes()), dict))
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), string(data))
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{WindowBits: zlibng.Flate, Dictionary: dict})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+	assert.EQ(t, string(got), string(data))
+}
+
+func TestZlibDictionaryFunc(t *testing.T) {
+	dicts := [][]byte{
+		[]byte("hello, world. goodbye, world."),
+		[]byte("the quick brown fox jumps over the lazy dog"),
+	}
+	dictFunc := func(id uint32) ([]byte, error) {
+		for _, dict := range dicts {
+			if adler32.Checksum(dict) == id {
+				return dict, nil
+			}
+		}
+		return nil, errors.New("dictionary not found")
+	}
+	for _, dict := range dicts {
+		data := append([]byte("payload: "), dict...)
+		compressed := bytes.Buffer{}
+		zout, err := zlib.NewWriterLevelDict(&compressed, zlib.DefaultCompression, dict)
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{DictionaryFunc: dictFunc})
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.NoError(t, zin.Close())
+		assert.EQ(t, string(got), string(data))
+
+		// Reading without a dictionary must fail. The pure-Go reader reports the
+		// error when it reads the stream header in NewReader.
+		zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()))
+		if err == nil {
+			_, err = ioutil.ReadAll(zin)
+		}
+		assert.Regexp(t, err, "need dictionary")
+	}
+}
+
+func TestZlibDictionaryRoundTrip(t *testing.T) {
+	dict := []byte("hello, world. goodbye, world.")
+	data := []byte("hello, world. hello, world. goodbye, world.")
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{WindowBits: 15, Level: -1, Dictionary: dict})
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	zin, err := zlib.NewReaderDict(bytes.NewReader(compressed.Bytes()), dict)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), string(data))
+
+	_, err = zlibng.NewWriter(&compressed, zlibng.Opts{Level: -1, Dictionary: dict})
+	assert.Regexp(t, err, "Gzip format")
+}
+
+func TestResetFormat(t *testing.T) {
+	data := []byte("hello, world. hello, world. goodbye, world.")
+	var (
+		zin  *zlibng.Reader
+		zout *zlibng.Writer
+		err  error
+	)
+	for i, windowBits := range []int{zlibng.Gzip, zlibng.Flate, 15, zlibng.Gzip} {
+		out := bytes.Buffer{}
+		opts := zlibng.Opts{WindowBits: windowBits, Level: -1}
+		if i == 0 {
+			zout, err = zlibng.NewWriter(&out, opts)
+		} else {
+			err = zout.Reset(&out, opts)
+		}
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		if i%2 == 0 {
+			assert.NoError(t, zout.Close())
+		} else {
+			// Reset must also work on a writer that isn't closed.
+			assert.NoError(t, zout.Flush())
+		}
+
+		if i == 0 {
+			zin, err = zlibng.NewReader(bytes.NewReader(out.Bytes()), opts)
+		} else {
+			err = zin.Reset(bytes.NewReader(out.Bytes()), opts)
+		}
+		assert.NoError(t, err)
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(zin, got)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), string(data))
+		if i%2 == 0 {
+			assert.NoError(t, zin.Close())
+		}
+	}
+}
+
+func TestZlibFormat(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 1000)
+	for _, strategy := range []int{zlibng.DefaultStrategy, zlibng.HuffmanOnlyStrategy} {
+		compressed := bytes.Buffer{}
+		zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{WindowBits: zlibng.Zlib, Level: -1, Strategy: strategy})
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		if strategy == zlibng.HuffmanOnlyStrategy {
+			// Huffman coding alone can't compress below 1 bit per byte.
+			assert.True(t, compressed.Len() > len(data)/8)
+		}
+
+		zin, err := zlib.NewReader(bytes.NewReader(compressed.Bytes()))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), string(data))
+
+		// Unset WindowBits detects the zlib header. Concatenated zlib streams are
+		// read as one stream.
+		twice := append(append([]byte{}, compressed.Bytes()...), compressed.Bytes()...)
+		for _, windowBits := range []int{zlibng.Zlib, 0} {
+			r, err := zlibng.NewReader(bytes.NewReader(twice), zlibng.Opts{WindowBits: windowBits})
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.NoError(t, r.Close())
+			assert.EQ(t, string(got), string(data)+string(data))
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 1000)
+	formats := []zlibng.Format{zlibng.FormatGzip, zlibng.FormatZlib, zlibng.FormatRaw}
+	var zin *zlibng.Reader
+	for _, format := range formats {
+		compressed := bytes.Buffer{}
+		zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{Format: format, Level: -1})
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		r, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Format: format})
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.EQ(t, string(got), string(data))
+
+		// FormatAuto detects the format again on each Reset.
+		if zin == nil {
+			zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Format: zlibng.FormatAuto})
+		} else {
+			err = zin.Reset(bytes.NewReader(compressed.Bytes()))
+		}
+		assert.NoError(t, err)
+		got, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err, "format=%d", format)
+		assert.EQ(t, string(got), string(data))
+		_, err = zin.Header()
+		assert.EQ(t, err == nil, format == zlibng.FormatGzip)
+	}
+	assert.NoError(t, zin.Close())
+
+	_, err := zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Format: zlibng.FormatAuto})
+	assert.Regexp(t, err, "only by the reader")
+	_, err = zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Format: zlibng.FormatZlib, WindowSize: 8})
+	assert.Regexp(t, err, "WindowSize 8 is not in")
+	_, err = zlibng.NewWriter(ioutil.Discard, zlibng.Opts{Format: zlibng.FormatZlib, WindowBits: zlibng.Zlib})
+	assert.Regexp(t, err, "cannot be set together")
+	_, err = zlibng.NewReader(bytes.NewReader(nil), zlibng.Opts{WindowSize: 12})
+	assert.Regexp(t, err, "only with Format")
+}
+
+func TestLimits(t *testing.T) {
+	data := make([]byte, 1<<20)
+	compressed, err := zlibng.Compress(nil, data, 9, zlibng.Gzip)
+	assert.NoError(t, err)
+
+	read := func(src []byte, opt zlibng.Opts) ([]byte, *zlibng.LimitError) {
+		zin, err := zlibng.NewReader(bytes.NewReader(src), opt)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		_ = zin.Close()
+		if err == nil {
+			return got, nil
+		}
+		assert.True(t, errors.Is(err, zlibng.ErrLimitExceeded), "err=%v", err)
+		var e *zlibng.LimitError
+		assert.True(t, errors.As(err, &e))
+		return got, e
+	}
+
+	got, e := read(compressed, zlibng.Opts{MaxOutputBytes: int64(len(data))})
+	assert.True(t, e == nil)
+	assert.EQ(t, len(got), len(data))
+
+	got, e = read(compressed, zlibng.Opts{MaxOutputBytes: 100000})
+	assert.EQ(t, e.Limit, "MaxOutputBytes")
+	assert.EQ(t, e.Out, int64(100000))
+	assert.EQ(t, len(got), 100000)
+
+	got, e = read(compressed, zlibng.Opts{MaxRatio: 10})
+	assert.EQ(t, e.Limit, "MaxRatio")
+	assert.EQ(t, e.Value, int64(10))
+	assert.EQ(t, e.Out, int64(len(got)))
+	assert.True(t, len(got) <= 10*len(compressed), "got %d bytes", len(got))
+
+	// Limit the number of members.
+	var multi []byte
+	for _, s := range []string{"a", "b", "c"} {
+		c, err := zlibng.Compress(nil, []byte(s), 5, zlibng.Gzip)
+		assert.NoError(t, err)
+		multi = append(multi, c...)
+	}
+	got, e = read(multi, zlibng.Opts{MaxMembers: 3})
+	assert.True(t, e == nil)
+	assert.EQ(t, string(got), "abc")
+	got, e = read(multi, zlibng.Opts{MaxMembers: 2})
+	assert.EQ(t, e.Limit, "MaxMembers")
+	assert.EQ(t, e.Member, 2)
+	assert.EQ(t, string(got), "ab")
+}
+
+// cancelWriter cancels a context on the first Write.
+type cancelWriter struct {
+	cancel func()
+	n      int
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	w.n += len(p)
+	return len(p), nil
+}
+
+// cancelReader cancels a context on the first Read.
+type cancelReader struct {
+	cancel func()
+	r      io.Reader
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.r.Read(p)
+}
+
+func TestContext(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 300000)
+	ctx := context.Background()
+	compressed := bytes.Buffer{}
+	n, err := zlibng.CopyCompressContext(ctx, &compressed, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	uncompressed := bytes.Buffer{}
+	n, err = zlibng.CopyUncompressContext(ctx, &uncompressed, bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.True(t, bytes.Equal(uncompressed.Bytes(), data))
+
+	// Cancel in the middle of the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancelWriter{cancel: cancel}
+	n, err = zlibng.CopyUncompressContext(ctx, w, bytes.NewReader(compressed.Bytes()))
+	assert.EQ(t, err, context.Canceled)
+	assert.EQ(t, n, int64(w.n))
+	assert.True(t, n < int64(len(data)))
+
+	// A canceled compression leaves the stream unfinished.
+	ctx, cancel = context.WithCancel(context.Background())
+	partial := bytes.Buffer{}
+	n, err = zlibng.CopyCompressContext(ctx, &partial, &cancelReader{cancel: cancel, r: bytes.NewReader(data)})
+	assert.EQ(t, err, context.Canceled)
+	assert.True(t, n < int64(len(data)))
+	_, err = zlibng.Uncompress(nil, partial.Bytes())
+	assert.NotNil(t, err)
+
+	// A large Write stops once the context is done.
+	zout, err := zlibng.NewWriterContext(ctx, ioutil.Discard)
+	assert.NoError(t, err)
+	written, err := zout.Write(data)
+	assert.EQ(t, err, context.Canceled)
+	assert.EQ(t, written, 0)
+	_ = zout.Close()
+
+	zin, err := zlibng.NewReaderContext(ctx, bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	_, err = zin.Read(make([]byte, len(data)))
+	assert.EQ(t, err, context.Canceled)
+	// The reader keeps the context after Reset.
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed.Bytes())))
+	_, err = zin.Read(make([]byte, 100))
+	assert.EQ(t, err, context.Canceled)
+	assert.NoError(t, zin.Close())
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 300000)
+	tmp, err := ioutil.TempDir("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "data")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	// *bytes.Buffer source.
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{Buffer: 4096})
+	assert.NoError(t, err)
+	n, err := zout.ReadFrom(bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.NoError(t, zout.Close())
+
+	// The data that the writer didn't take stays in the *bytes.Buffer source.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	zout, err = zlibng.NewWriterContext(ctx, ioutil.Discard)
+	assert.NoError(t, err)
+	src := bytes.NewBuffer(data)
+	n, err = zout.ReadFrom(src)
+	assert.EQ(t, err, context.Canceled)
+	assert.EQ(t, n, int64(0))
+	assert.EQ(t, src.Len(), len(data))
+	_ = zout.Close()
+
+	// *os.File source, through io.Copy.
+	in, err := os.Open(path)
+	assert.NoError(t, err)
+	fileCompressed := bytes.Buffer{}
+	zout, err = zlibng.NewWriter(&fileCompressed, zlibng.Opts{Buffer: 4096})
+	assert.NoError(t, err)
+	n, err = io.Copy(zout, in)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.NoError(t, zout.Close())
+	assert.NoError(t, in.Close())
+	got, err := zlibng.Uncompress(nil, fileCompressed.Bytes())
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	// *bytes.Buffer destination.
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Buffer: 4096})
+	assert.NoError(t, err)
+	uncompressed := bytes.Buffer{}
+	n, err = zin.WriteTo(&uncompressed)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.True(t, bytes.Equal(uncompressed.Bytes(), data))
+	assert.NoError(t, zin.Close())
+
+	// *os.File destination, through io.Copy.
+	out, err := os.Create(path + ".out")
+	assert.NoError(t, err)
+	zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Buffer: 4096})
+	assert.NoError(t, err)
+	n, err = io.Copy(out, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.NoError(t, zin.Close())
+	assert.NoError(t, out.Close())
+	got, err = ioutil.ReadFile(path + ".out")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	// Errors are reported along with the bytes written so far.
+	zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{MaxOutputBytes: 1000})
+	assert.NoError(t, err)
+	uncompressed.Reset()
+	n, err = zin.WriteTo(&uncompressed)
+	assert.True(t, errors.Is(err, zlibng.ErrLimitExceeded), "err=%v", err)
+	assert.EQ(t, n, int64(1000))
+	assert.True(t, bytes.Equal(uncompressed.Bytes(), data[:1000]))
+	_ = zin.Close()
+}
+
+func TestStats(t *testing.T) {
+	data0 := bytes.Repeat([]byte("hello, world. "), 100000)
+	data1 := []byte("second member")
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed)
+	assert.NoError(t, err)
+	_, err = zout.Write(data0[:1000])
+	assert.NoError(t, err)
+	st := zout.Stats()
+	assert.EQ(t, st.Uncompressed, int64(1000))
+	assert.EQ(t, st.Checksum, crc32.ChecksumIEEE(data0[:1000]))
+	_, err = zout.Write(data0[1000:])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	st = zout.Stats()
+	assert.EQ(t, st.Compressed, int64(compressed.Len()))
+	assert.EQ(t, st.Uncompressed, int64(len(data0)))
+	assert.EQ(t, st.Members, 1)
+	assert.EQ(t, st.Checksum, crc32.ChecksumIEEE(data0))
+	assert.NoError(t, zout.Reset(&compressed))
+	assert.EQ(t, zout.Stats().Uncompressed, int64(0))
+	_, err = zout.Write(data1)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	buf := make([]byte, 5000)
+	_, err = io.ReadFull(zin, buf)
+	assert.NoError(t, err)
+	st = zin.Stats()
+	assert.EQ(t, st.Uncompressed, int64(len(buf)))
+	assert.EQ(t, st.Members, 1)
+	assert.EQ(t, st.Checksum, crc32.ChecksumIEEE(data0[:len(buf)]))
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+	st = zin.Stats()
+	assert.EQ(t, st.Compressed, int64(compressed.Len()))
+	assert.EQ(t, st.Uncompressed, int64(len(data0)+len(data1)))
+	assert.EQ(t, st.Members, 2)
+	assert.EQ(t, st.Checksum, crc32.ChecksumIEEE(data1))
+
+	for _, format := range []zlibng.Format{zlibng.FormatZlib, zlibng.FormatRaw} {
+		want := adler32.Checksum(data0)
+		if format == zlibng.FormatRaw {
+			want = 0
+		}
+		compressed.Reset()
+		zout, err = zlibng.NewWriter(&compressed, zlibng.Opts{Level: -1, Format: format})
+		assert.NoError(t, err)
+		_, err = zout.Write(data0)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		assert.EQ(t, zout.Stats().Checksum, want)
+		zin, err = zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Format: format})
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, zin.Stats().Checksum, want)
+		assert.EQ(t, zin.Stats().Members, 1)
+		assert.NoError(t, zin.Close())
+	}
+}
+
+func TestCompress(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	inputs := [][]byte{nil, []byte("Blah"), bytes.Repeat([]byte("Hello, world. "), 100000)}
+	random := make([]byte, 100000)
+	_, _ = r.Read(random)
+	inputs = append(inputs, random)
+
+	for _, format := range []int{zlibng.Gzip, zlibng.Zlib, zlibng.Flate} {
+		for _, data := range inputs {
+			compressed, err := zlibng.Compress(nil, data, -1, format)
+			assert.NoError(t, err)
+			assert.True(t, len(compressed) <= zlibng.CompressBound(len(data)), "format=%d len=%d got=%d", format, len(data), len(compressed))
+
+			var zin io.Reader
+			switch format {
+			case zlibng.Gzip:
+				zin, err = gzip.NewReader(bytes.NewReader(compressed))
+				assert.NoError(t, err)
+			case zlibng.Zlib:
+				zin, err = zlib.NewReader(bytes.NewReader(compressed))
+				assert.NoError(t, err)
+			default:
+				zin = flate.NewReader(bytes.NewReader(compressed))
+			}
+			got, err := ioutil.ReadAll(zin)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data), "format=%d len=%d", format, len(data))
+
+			got, err = zlibng.Uncompress(nil, compressed)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data), "format=%d len=%d", format, len(data))
+
+			// Reuse dst.
+			dst := make([]byte, 0, len(data)+1)
+			got, err = zlibng.Uncompress(dst, compressed)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data), "format=%d len=%d", format, len(data))
+			if len(data) > 0 {
+				assert.True(t, &got[0] == &dst[:1][0])
+			}
+
+			if len(compressed) > 10 {
+				_, err = zlibng.Uncompress(nil, compressed[:len(compressed)/2])
+				assert.NotNil(t, err)
+			}
+		}
+	}
+
+	// Multiple gzip members.
+	m0, err := zlibng.Compress(nil, []byte("hello, "), 9, zlibng.Gzip)
+	assert.NoError(t, err)
+	m1, err := zlibng.Compress(nil, []byte("world"), 1, zlibng.Gzip)
+	assert.NoError(t, err)
+	got, err := zlibng.Uncompress(nil, append(m0, m1...))
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello, world")
+
+	_, err = zlibng.Compress(nil, inputs[1], 10, zlibng.Gzip)
+	assert.Regexp(t, err, "invalid compression level")
+	_, err = zlibng.Compress(nil, inputs[1], 1, 12)
+	assert.Regexp(t, err, "format must be")
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 1<<20)
+	_, _ = r.Read(data)
+	for _, format := range []int{zlibng.Gzip, zlibng.Zlib, zlibng.Flate} {
+		for level := -1; level <= 9; level++ {
+			for _, n := range []int{1, 1000, 100000, len(data)} {
+				compressed, err := zlibng.Compress(nil, data[:n], level, format)
+				assert.NoError(t, err, "format=%d level=%d len=%d", format, level, n)
+				assert.True(t, len(compressed) <= zlibng.CompressBound(n), "format=%d level=%d len=%d got=%d", format, level, n, len(compressed))
+				got, err := zlibng.Uncompress(nil, compressed)
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(got, data[:n]), "format=%d level=%d len=%d", format, level, n)
+			}
+		}
+	}
+}
+
+func TestMultistream(t *testing.T) {
+	members := []string{"hello, ", "", "world", strings.Repeat("blah", 100000)}
+	compressed := bytes.Buffer{}
+	for _, m := range members {
+		gz := gzip.NewWriter(&compressed)
+		_, err := gz.Write([]byte(m))
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	}
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{Buffer: 1024})
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), strings.Join(members, ""))
+
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed.Bytes())))
+	zin.Multistream(false)
+	for i, m := range members {
+		if i > 0 {
+			assert.NoError(t, zin.NextMember())
+		}
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), m)
+	}
+	assert.EQ(t, zin.NextMember(), io.EOF)
+
+	// NextMember skips the rest of the current member.
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed.Bytes())))
+	zin.Multistream(false)
+	var buf [3]byte
+	_, err = io.ReadFull(zin, buf[:])
+	assert.NoError(t, err)
+	assert.EQ(t, string(buf[:]), "hel")
+	assert.NoError(t, zin.NextMember())
+	assert.NoError(t, zin.NextMember())
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "world")
+	assert.NoError(t, zin.Close())
+}
+
+func TestFlateTrailingData(t *testing.T) {
+	compressed := bytes.Buffer{}
+	fl, err := flate.NewWriter(&compressed, 5)
+	assert.NoError(t, err)
+	_, err = fl.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, fl.Close())
+	compressed.WriteString("trailing garbage")
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), zlibng.Opts{WindowBits: zlibng.Flate})
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+	assert.NotNil(t, zin.NextMember())
+}
+
+func TestUncompressTrailingData(t *testing.T) {
+	for _, windowBits := range []int{zlibng.Zlib, zlibng.Flate} {
+		compressed := bytes.Buffer{}
+		zout, err := zlibng.NewWriter(&compressed, zlibng.Opts{WindowBits: windowBits})
+		assert.NoError(t, err)
+		_, err = zout.Write([]byte("hello"))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		got, err := zlibng.Uncompress(nil, compressed.Bytes())
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "hello")
+
+		compressed.WriteString("trailing garbage")
+		_, err = zlibng.Uncompress(nil, compressed.Bytes())
+		assert.Regexp(t, err, "trailing data after the end of the stream")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	compressed := bytes.Buffer{}
+	for _, m := range []string{"hello", strings.Repeat("world", 1000)} {
+		gz := gzip.NewWriter(&compressed)
+		_, err := gz.Write([]byte(m))
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	}
+	readAll := func(data []byte) error {
+		zin, err := zlibng.NewReader(bytes.NewReader(data))
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		return err
+	}
+
+	// Flip a bit in the CRC of the second member.
+	data := append([]byte{}, compressed.Bytes()...)
+	data[len(data)-8] ^= 1
+	err := readAll(data)
+	assert.True(t, errors.Is(err, zlibng.ErrChecksum), "err=%v", err)
+	assert.True(t, errors.Is(err, zlibng.ErrDataError), "err=%v", err)
+	var se *zlibng.StreamError
+	assert.True(t, errors.As(err, &se))
+	assert.EQ(t, se.Member, 1)
+	assert.EQ(t, se.Out, int64(5+5000))
+
+	_, err = zlibng.Uncompress(nil, data)
+	assert.True(t, errors.Is(err, zlibng.ErrChecksum), "err=%v", err)
+
+	// Corrupt the deflate data of the first member.
+	data = append([]byte{}, compressed.Bytes()...)
+	data[10] = 0xff
+	err = readAll(data)
+	assert.True(t, errors.Is(err, zlibng.ErrDataError), "err=%v", err)
+	assert.False(t, errors.Is(err, zlibng.ErrChecksum), "err=%v", err)
+	assert.True(t, errors.As(err, &se))
+	assert.EQ(t, se.Member, 0)
+}
+
+func TestTruncated(t *testing.T) {
+	data := bytes.Repeat([]byte("hello, world. "), 10000)
+	for _, format := range []int{zlibng.Gzip, zlibng.Flate} {
+		compressed, err := zlibng.Compress(nil, data, 5, format)
+		assert.NoError(t, err)
+		for _, n := range []int{0, 1, 10, len(compressed) / 2, len(compressed) - 1} {
+			zin, err := zlibng.NewReader(bytes.NewReader(compressed[:n]), zlibng.Opts{WindowBits: format})
+			if err == nil {
+				_, err = ioutil.ReadAll(zin)
+				assert.EQ(t, zin.Close(), err)
+			}
+			assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "format=%d n=%d err=%v", format, n, err)
+
+			_, err = zlibng.Uncompress(nil, compressed[:n])
+			assert.NotNil(t, err, "format=%d n=%d", format, n)
+		}
+	}
+}
+
+// TestSmallReads reads a stream one input byte at a time, into small output
+// buffers, so that inflate consumes all the input before it can write all the
+// output.
+func TestSmallReads(t *testing.T) {
+	for _, test := range []struct {
+		format, level, reps int
+	}{
+		{zlibng.Gzip, 5, 7142},
+		{zlibng.Zlib, 5, 7142},
+		{zlibng.Flate, 5, 7142},
+		{zlibng.Flate, 9, 714},
+		{zlibng.Flate, 9, 10000},
+	} {
+		format := test.format
+		data := bytes.Repeat([]byte("hello, world. "), test.reps)
+		compressed, err := zlibng.Compress(nil, data, test.level, format)
+		assert.NoError(t, err)
+		for _, n := range []int{1, 7} {
+			zin, err := zlibng.NewReader(iotest.OneByteReader(bytes.NewReader(compressed)),
+				zlibng.Opts{WindowBits: format, Buffer: 1})
+			assert.NoError(t, err)
+			var (
+				got []byte
+				buf = make([]byte, n)
+			)
+			for {
+				m, err := zin.Read(buf)
+				got = append(got, buf[:m]...)
+				if err == io.EOF {
+					break
+				}
+				assert.NoError(t, err, "test=%+v n=%d", test, n)
+			}
+			assert.True(t, bytes.Equal(got, data), "test=%+v n=%d", test, n)
+			assert.NoError(t, zin.Close())
+		}
+	}
+}
+
+func TestDeflateHeader(t *testing.T) {
+	out := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&out)
+	assert.NoError(t, err)
+
+	now := time.Unix(time.Now().Unix(), 0)
+	wantHeader := zlibng.GzipHeader{Comment: "hello", Name: "blah", Extra: []byte{3, 2, 1}, ModTime: now, OS: 11}
+	assert.NoError(t, zout.SetHeader(wantHeader))
+	data := []byte("testdata")
+	n, err := zout.Write(data)
+	assert.NoError(t, err)
+	assert.EQ(t, n, len(data))
+	assert.NoError(t, zout.Close())
+	{
+		zin, err := zlibng.NewReader(bytes.NewReader(out.Bytes()))
+		assert.NoError(t, err)
+		got := bytes.Buffer{}
+		_, err = io.Copy(&got, zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got.Bytes()), string(data))
+		gotHeader, err := zin.Header()
+		assert.NoError(t, err)
+		assert.EQ(t, gotHeader, wantHeader)
+	}
+	{
+		zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+		assert.NoError(t, err)
+		got := bytes.Buffer{}
+		_, err = io.Copy(&got, zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got.Bytes()), string(data))
+	}
+}
+
+func TestMemberHeader(t *testing.T) {
+	compressed := bytes.Buffer{}
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	for _, name := range names {
+		zout, err := zlibng.NewWriter(&compressed)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetHeader(zlibng.GzipHeader{Name: name}))
+		_, err = zout.Write([]byte(name))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+	}
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()))
+	assert.NoError(t, err)
+	zin.Multistream(false)
+	for i, name := range names {
+		if i > 0 {
+			assert.NoError(t, zin.NextMember())
+		}
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), name)
+		h, err := zin.Header()
+		assert.NoError(t, err)
+		assert.EQ(t, h.Name, name)
+	}
+	assert.EQ(t, zin.NextMember(), io.EOF)
+
+	// In multistream mode, Header reports the last member at the end.
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed.Bytes())))
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "a.txtb.txtc.txt")
+	h, err := zin.Header()
+	assert.NoError(t, err)
+	assert.EQ(t, h.Name, "c.txt")
+	assert.NoError(t, zin.Close())
+}
+
+func TestHeaderFieldLimit(t *testing.T) {
+	// The pure-Go reader rejects names and comments longer than 511 bytes.
+	longName := strings.Repeat("n", 300)
+	extra := bytes.Repeat([]byte{1, 2, 3}, 20000)
+	compressed := bytes.Buffer{}
+	zout, err := zlibng.NewWriter(&compressed)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetHeader(zlibng.GzipHeader{Name: longName, Comment: "c", Extra: extra}))
+	_, err = zout.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	readHeader := func(opts ...zlibng.Opts) zlibng.GzipHeader {
+		zin, err := zlibng.NewReader(bytes.NewReader(compressed.Bytes()), opts...)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "data")
+		h, err := zin.Header()
+		assert.NoError(t, err)
+		assert.NoError(t, zin.Close())
+		return h
+	}
+
+	// The default limit supports the full Extra field.
+	h := readHeader()
+	assert.EQ(t, h.Name, longName)
+	assert.EQ(t, h.Comment, "c")
+	assert.EQ(t, h.Extra, extra)
+	assert.False(t, h.Truncated)
+
+	h = readHeader(zlibng.Opts{MaxHeaderField: 300})
+	assert.EQ(t, h.Name, longName)
+	assert.EQ(t, h.Extra, extra[:300])
+	assert.True(t, h.Truncated)
+
+	h = readHeader(zlibng.Opts{MaxHeaderField: 299})
+	assert.EQ(t, h.Name, longName[:299])
+	assert.True(t, h.Truncated)
+}
+
+func TestReset(t *testing.T) {
+	inputs := [][]byte{[]byte("Blah"), nil, bytes.Repeat([]byte("Hello, world. "), 1000)}
+	var compressed [][]byte
+	zout, err := zlibng.NewWriter(ioutil.Discard)
+	assert.NoError(t, err)
+	for _, data := range inputs {
+		out := bytes.Buffer{}
+		assert.NoError(t, zout.Reset(&out))
+		_, err := zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		compressed = append(compressed, out.Bytes())
+	}
+
+	zin, err := zlibng.NewReader(bytes.NewReader(compressed[0]))
+	assert.NoError(t, err)
+	for i, data := range inputs {
+		if i > 0 {
+			assert.NoError(t, zin.Reset(bytes.NewReader(compressed[i])))
+		}
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), string(data))
+	}
+
+	// Reset in the middle of a stream must discard the remaining input.
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed[2])))
+	got := make([]byte, 10)
+	_, err = io.ReadFull(zin, got)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressed[0])))
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), string(inputs[0]))
+	assert.NoError(t, zin.Close())
+}
+
 func TestDeflateRandom(t *testing.T) {
 	for iter := 0; iter < 20; iter++ {
 		i := iter
@@ -3,25 +3,130 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
-#include "./zlib-ng.h"
+#include "./zbuild.h"
+#include "./deflate.h"
+
+typedef struct zs_state {
+  zng_stream zs;
+  zs_mem mem;
+} zs_state;
+
+// Each allocation is prefixed by a header that records its size. 16 bytes keep
+// the alignment of malloc.
+#define ZS_ALLOC_HEADER 16
+
+static long long zs_total_mem_in_use;
+static long long zs_mem_limit;
+
+static void* zs_alloc(void* opaque, unsigned items, unsigned size) {
+  zs_mem* mem = (zs_mem*)opaque;
+  long long n = (long long)items * size;
+  long long total = __atomic_add_fetch(&zs_total_mem_in_use, n, __ATOMIC_RELAXED);
+  long long limit = __atomic_load_n(&zs_mem_limit, __ATOMIC_RELAXED);
+  char* p = NULL;
+  if (limit > 0 && total > limit) {
+    mem->limit_exceeded = 1;
+  } else {
+    p = malloc(ZS_ALLOC_HEADER + n);
+  }
+  if (p == NULL) {
+    __atomic_sub_fetch(&zs_total_mem_in_use, n, __ATOMIC_RELAXED);
+    return NULL;
+  }
+  *(long long*)p = n;
+  mem->in_use += n;
+  return p + ZS_ALLOC_HEADER;
+}
+
+static void zs_free(void* opaque, void* ptr) {
+  if (ptr == NULL) {
+    return;
+  }
+  zs_mem* mem = (zs_mem*)opaque;
+  char* p = (char*)ptr - ZS_ALLOC_HEADER;
+  long long n = *(long long*)p;
+  mem->in_use -= n;
+  __atomic_sub_fetch(&zs_total_mem_in_use, n, __ATOMIC_RELAXED);
+  free(p);
+}
+
+// Clears the stream state and installs the allocation hooks.
+static void zs_state_init(zs_state* st) {
+  memset(st, 0, sizeof(*st));
+  st->zs.zalloc = zs_alloc;
+  st->zs.zfree = zs_free;
+  st->zs.opaque = &st->mem;
+}
+
+long long zs_get_mem_in_use(char* stream) {
+  return ((zs_state*)stream)->mem.in_use;
+}
+
+int zs_take_mem_limit_exceeded(char* stream) {
+  zs_mem* mem = &((zs_state*)stream)->mem;
+  int v = mem->limit_exceeded;
+  mem->limit_exceeded = 0;
+  return v;
+}
+
+long long zs_get_total_mem_in_use() {
+  return __atomic_load_n(&zs_total_mem_in_use, __ATOMIC_RELAXED);
+}
+
+long long zs_set_mem_limit(long long limit) {
+  return __atomic_exchange_n(&zs_mem_limit, limit, __ATOMIC_RELAXED);
+}
+
+long long zs_get_mem_limit() {
+  return __atomic_load_n(&zs_mem_limit, __ATOMIC_RELAXED);
+}
+
+void* zs_mem_alloc(char* stream, size_t n) {
+  return zs_alloc(&((zs_state*)stream)->mem, 1, (unsigned)n);
+}
+
+void zs_mem_free(char* stream, void* p) {
+  zs_free(&((zs_state*)stream)->mem, p);
+}
 
 int zs_inflate_init(char* stream, int window_bits, struct zng_gz_header_s* h,
                     int* get_header_status) {
   zng_stream* zs = (zng_stream*)stream;
-  memset(zs, 0, sizeof(*zs));
+  zs_state_init((zs_state*)stream);
   int ec = zng_inflateInit2(zs, window_bits);
   if (ec != 0) {
     return ec;
   }
-  *get_header_status = zng_inflateGetHeader(zs, h);
+  *get_header_status = (h == NULL) ? Z_OK : zng_inflateGetHeader(zs, h);
   return 0;
 }
 
 int zs_inflate_end(char* stream) { return zng_inflateEnd((zng_stream*)stream); }
 
-int zs_inflate_reset(char* stream) {
+int zs_inflate_reset(char* stream, struct zng_gz_header_s* h,
+                     int* get_header_status) {
   zng_stream* zs = (zng_stream*)stream;
-  return zng_inflateReset(zs);
+  int ec = zng_inflateReset(zs);
+  if (ec != 0) {
+    return ec;
+  }
+  // inflateReset forgets the header set by inflateGetHeader.
+  *get_header_status = (h == NULL) ? Z_OK : zng_inflateGetHeader(zs, h);
+  return 0;
+}
+
+int zs_inflate_reset2(char* stream, int window_bits, struct zng_gz_header_s* h,
+                      int* get_header_status) {
+  zng_stream* zs = (zng_stream*)stream;
+  int ec = zng_inflateReset2(zs, window_bits);
+  if (ec != 0) {
+    return ec;
+  }
+  // Discard the input left over from the previous stream.
+  zs->next_in = NULL;
+  zs->avail_in = 0;
+  *get_header_status = zng_inflateGetHeader(zs, h);
+  return 0;
 }
 
 int zs_get_errno() { return errno; }
@@ -29,6 +134,55 @@ int zs_get_errno() { return errno; }
 int zs_inflate(char* stream, void* in, int in_bytes, void* out, int* out_bytes,
                int* consumed_input) {
   zng_stream* zs = (zng_stream*)stream;
+  if (in_bytes > 0) {
+    if (zs->avail_in != 0) {
+      abort();
+    }
+    zs->avail_in = in_bytes;
+    zs->next_in = in;
+  }
+  // With no input left, inflate may still produce the output for the input it
+  // has already consumed.
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = zng_inflate((zng_stream*)stream, Z_NO_FLUSH);
+  if (ret == Z_OK || ret == Z_STREAM_END) {
+    *out_bytes = zs->avail_out;
+  }
+  *consumed_input = (zs->avail_in == 0);
+  return ret;
+}
+
+int zs_inflate_header(char* stream, void* in, int in_bytes, int max_in,
+                      void* out, int* out_bytes, int* consumed_input) {
+  zng_stream* zs = (zng_stream*)stream;
+  if (in_bytes > 0) {
+    if (zs->avail_in != 0) {
+      abort();
+    }
+    zs->avail_in = in_bytes;
+    zs->next_in = in;
+  }
+  // Hide the input beyond max_in from inflate.
+  unsigned held = 0;
+  if (zs->avail_in > (unsigned)max_in) {
+    held = zs->avail_in - max_in;
+    zs->avail_in = max_in;
+  }
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = zng_inflate(zs, Z_NO_FLUSH);
+  zs->avail_in += held;
+  if (ret == Z_OK || ret == Z_STREAM_END) {
+    *out_bytes = zs->avail_out;
+  }
+  *consumed_input = (zs->avail_in == 0);
+  return ret;
+}
+
+int zs_inflate_block(char* stream, void* in, int in_bytes, void* out,
+                     int* out_bytes, int* consumed_input, int* data_type) {
+  zng_stream* zs = (zng_stream*)stream;
   if (in_bytes > 0) {
     if (zs->avail_in != 0) {
       abort();
@@ -42,22 +196,43 @@ int zs_inflate(char* stream, void* in, int in_bytes, void* out, int* out_bytes,
   }
   zs->next_out = out;
   zs->avail_out = *out_bytes;
-  int ret = zng_inflate((zng_stream*)stream, Z_NO_FLUSH);
+  int ret = zng_inflate(zs, Z_BLOCK);
   if (ret == Z_OK || ret == Z_STREAM_END) {
     *out_bytes = zs->avail_out;
   }
   *consumed_input = (zs->avail_in == 0);
+  *data_type = zs->data_type;
   return ret;
 }
 
+int zs_inflate_prime(char* stream, int bits, int value) {
+  return zng_inflatePrime((zng_stream*)stream, bits, value);
+}
+
+int zs_inflate_set_dictionary(char* stream, void* dict, int dict_bytes) {
+  return zng_inflateSetDictionary((zng_stream*)stream, dict, dict_bytes);
+}
+
 int zs_deflate_init(char* stream, int level, int window_bits, int mem_level,
                     int strategy) {
   zng_stream* zs = (zng_stream*)stream;
-  memset(zs, 0, sizeof(*zs));
+  zs_state_init((zs_state*)stream);
   return zng_deflateInit2(zs, level, Z_DEFLATED, window_bits, mem_level,
                           strategy);
 }
 
+int zs_deflate_reset(char* stream) {
+  zng_stream* zs = (zng_stream*)stream;
+  int ec = zng_deflateReset(zs);
+  if (ec != 0) {
+    return ec;
+  }
+  // Forget the header set by the previous zs_deflate_set_header call. It fails
+  // harmlessly unless the format is gzip.
+  zng_deflateSetHeader(zs, NULL);
+  return 0;
+}
+
 int zs_deflate(char* stream, void* in, int in_bytes, void* out, int* out_bytes,
                int* consumed_input) {
   zng_stream* zs = (zng_stream*)stream;
@@ -78,21 +253,175 @@ int zs_deflate(char* stream, void* in, int in_bytes, void* out, int* out_bytes,
   return ret;
 }
 
-int zs_deflate_end(char* stream, void* out, int* out_bytes) {
+int zs_deflate_flush(char* stream, int flush, void* out, int* out_bytes) {
+  zng_stream* zs = (zng_stream*)stream;
+  if (zs->avail_in != 0) {
+    abort();
+  }
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = zng_deflate(zs, flush);
+  *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_deflate_params(char* stream, int level, int strategy, void* out,
+                      int* out_bytes) {
   zng_stream* zs = (zng_stream*)stream;
   if (zs->avail_in != 0) {
     abort();
   }
   zs->next_out = out;
   zs->avail_out = *out_bytes;
+  int ret = zng_deflateParams(zs, level, strategy);
+  *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_deflate_tune(char* stream, int good_length, int max_lazy,
+                    int nice_length, int max_chain) {
+  zng_stream* zs = (zng_stream*)stream;
+  deflate_state* s = (deflate_state*)zs->state;
+  if (s == NULL) {
+    return Z_STREAM_ERROR;
+  }
+  if (good_length == 0) {
+    good_length = s->good_match;
+  }
+  if (max_lazy == 0) {
+    max_lazy = s->max_lazy_match;
+  }
+  if (nice_length == 0) {
+    nice_length = s->nice_match;
+  }
+  if (max_chain == 0) {
+    max_chain = s->max_chain_length;
+  }
+  return zng_deflateTune(zs, good_length, max_lazy, nice_length, max_chain);
+}
+
+int zs_deflate_finish(char* stream, void* out, int* out_bytes) {
+  zng_stream* zs = (zng_stream*)stream;
+  if (zs->avail_in != 0) {
+    abort();
+  }
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  // The deflate state is kept after Z_STREAM_END, so that zs_deflate_reset can
+  // reuse it. zs_deflate_free frees it.
   int ret = zng_deflate(zs, Z_FINISH);
   *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_deflate_block(char* stream, void* dict, int dict_bytes, void* in,
+                     int in_bytes, void* out, int* out_bytes, int last) {
+  zng_stream* zs = (zng_stream*)stream;
+  int ret = zng_deflateReset(zs);
   if (ret != Z_OK) {
-    zng_deflateEnd(zs);
+    return ret;
   }
-  return ret;
+  if (dict_bytes > 0) {
+    ret = zng_deflateSetDictionary(zs, dict, dict_bytes);
+    if (ret != Z_OK) {
+      return ret;
+    }
+  }
+  zs->next_in = in;
+  zs->avail_in = in_bytes;
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  // deflate may return before consuming all the input, so it is called until
+  // the input is consumed and the flush is complete, or until out fills up.
+  for (;;) {
+    ret = zng_deflate(zs, last ? Z_FINISH : Z_SYNC_FLUSH);
+    if (ret != Z_OK || zs->avail_out == 0) {
+      break;
+    }
+    // For a sync flush, avail_out!=0 means the flush is complete.
+    if (!last && zs->avail_in == 0) {
+      break;
+    }
+  }
+  *out_bytes = zs->avail_out;
+  zs->next_in = NULL;
+  if (ret != Z_OK && ret != Z_STREAM_END) {
+    zs->avail_in = 0;
+    return ret;
+  }
+  // For a sync flush, avail_out=0 means the flush may be incomplete.
+  if (zs->avail_in != 0 || (last && ret != Z_STREAM_END) ||
+      (!last && zs->avail_out == 0)) {
+    zs->avail_in = 0;
+    return Z_BUF_ERROR;
+  }
+  return Z_OK;
 }
 
 int zs_deflate_set_header(char* stream, zng_gz_header* h) {
   return zng_deflateSetHeader((zng_stream*)stream, h);
 }
+
+int zs_deflate_set_dictionary(char* stream, void* dict, int dict_bytes) {
+  return zng_deflateSetDictionary((zng_stream*)stream, dict, dict_bytes);
+}
+
+int zs_deflate_free(char* stream) { return zng_deflateEnd((zng_stream*)stream); }
+
+unsigned zs_get_adler(char* stream) { return ((zng_stream*)stream)->adler; }
+
+long long zs_get_total_in(char* stream) { return ((zng_stream*)stream)->total_in; }
+
+long long zs_get_total_out(char* stream) { return ((zng_stream*)stream)->total_out; }
+
+const char* zs_get_msg(char* stream) { return ((zng_stream*)stream)->msg; }
+
+int zs_compress(int level, int window_bits, void* in, size_t in_bytes,
+                void* out, size_t* out_bytes) {
+  // Same as zng_compress2, but it supports all the formats.
+  const unsigned int max = (unsigned int)-1;
+  size_t left = *out_bytes;
+  zs_state st;
+  zng_stream* zs = &st.zs;
+  *out_bytes = 0;
+  zs_state_init(&st);
+  int ret = zng_deflateInit2(zs, level, Z_DEFLATED, window_bits, 8,
+                             Z_DEFAULT_STRATEGY);
+  if (ret != Z_OK) {
+    return ret;
+  }
+  zs->next_out = out;
+  zs->next_in = in;
+  do {
+    if (zs->avail_out == 0) {
+      zs->avail_out = left > max ? max : (unsigned int)left;
+      left -= zs->avail_out;
+    }
+    if (zs->avail_in == 0) {
+      zs->avail_in = in_bytes > max ? max : (unsigned int)in_bytes;
+      in_bytes -= zs->avail_in;
+    }
+    ret = zng_deflate(zs, in_bytes ? Z_NO_FLUSH : Z_FINISH);
+  } while (ret == Z_OK);
+  *out_bytes = zs->total_out;
+  zng_deflateEnd(zs);
+  return ret == Z_STREAM_END ? Z_OK : ret;
+}
+
+int zs_inflate_buf(char* stream, void* in, size_t* in_bytes, void* out,
+                   size_t* out_bytes) {
+  const unsigned int max = (unsigned int)-1;
+  zng_stream* zs = (zng_stream*)stream;
+  zs->next_in = in;
+  zs->avail_in = *in_bytes > max ? max : (unsigned int)*in_bytes;
+  zs->next_out = out;
+  zs->avail_out = *out_bytes > max ? max : (unsigned int)*out_bytes;
+  size_t in_extra = *in_bytes - zs->avail_in;
+  size_t out_extra = *out_bytes - zs->avail_out;
+  int ret = zng_inflate(zs, Z_NO_FLUSH);
+  *in_bytes = zs->avail_in + in_extra;
+  *out_bytes = zs->avail_out + out_extra;
+  zs->next_in = NULL;
+  zs->avail_in = 0;
+  return ret;
+}
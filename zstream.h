@@ -1,20 +1,106 @@
 #ifndef ZSTREAM_H
 #define ZSTREAM_H
 
+#include <stddef.h>
+
 struct zng_gz_header_s;
+
+// Memory accounting. The stream buffer passed to the zs_* functions is a
+// zng_stream followed by a zs_mem. zlib-ng allocates the stream state through
+// hooks that update zs_mem and the process-wide total, and that fail once the
+// total would exceed the limit set by zs_set_mem_limit.
+typedef struct zs_mem {
+  long long in_use;    // bytes allocated by the stream.
+  int limit_exceeded;  // set when an allocation failed because of the limit.
+} zs_mem;
+
+// Returns the bytes allocated by the stream.
+extern long long zs_get_mem_in_use(char* stream);
+// Returns whether an allocation failed because of the limit since the last
+// call, and clears the flag.
+extern int zs_take_mem_limit_exceeded(char* stream);
+// Returns the bytes allocated by all the streams.
+extern long long zs_get_total_mem_in_use();
+// Sets the limit of zs_get_total_mem_in_use. Zero means no limit. Returns the
+// old limit.
+extern long long zs_set_mem_limit(long long limit);
+extern long long zs_get_mem_limit();
+// Allocates and frees memory that is accounted to the stream, e.g., buffers
+// owned by the caller. The memory must be freed before the stream is
+// reinitialized by zs_inflate_init or zs_deflate_init.
+extern void* zs_mem_alloc(char* stream, size_t n);
+extern void zs_mem_free(char* stream, void* p);
+
 extern int zs_inflate_init(char* stream, int window_bits, struct zng_gz_header_s* h, int* get_header_status);
-extern int zs_inflate_reset(char* stream);
+// Resets the stream for the next gzip member. Unlike zs_inflate_reset2, it keeps
+// the unconsumed input.
+extern int zs_inflate_reset(char* stream, struct zng_gz_header_s* h, int* get_header_status);
+extern int zs_inflate_reset2(char* stream, int window_bits, struct zng_gz_header_s* h, int* get_header_status);
 extern int zs_inflate_end(char* stream);
 extern int zs_inflate(char* stream, void* in, int in_bytes, void* out,
                       int* out_bytes, int* consumed_input);
+// Similar to zs_inflate, but inflate sees at most max_in bytes of the input, so
+// that the caller can grow the gzip header buffers between calls.
+extern int zs_inflate_header(char* stream, void* in, int in_bytes, int max_in,
+                             void* out, int* out_bytes, int* consumed_input);
+extern int zs_inflate_set_dictionary(char* stream, void* dict, int dict_bytes);
+extern int zs_inflate_prime(char* stream, int bits, int value);
+
+// Similar to zs_inflate, but inflates with Z_BLOCK, i.e., stops at the end of
+// each deflate block. *data_type is set to zng_stream.data_type.
+extern int zs_inflate_block(char* stream, void* in, int in_bytes, void* out,
+                            int* out_bytes, int* consumed_input, int* data_type);
 
 // format is one of Gzip or Flate.
 extern int zs_deflate_init(char* stream, int level, int window_bits,
                            int mem_level, int strategy);
+extern int zs_deflate_reset(char* stream);
 extern int zs_deflate_set_header(char* stream, struct zng_gz_header_s* h);
+extern int zs_deflate_set_dictionary(char* stream, void* dict, int dict_bytes);
 extern int zs_deflate(char* stream, void* in, int in_bytes, void* out,
                       int* out_bytes, int* consumed_input);
-extern int zs_deflate_end(char* stream, void* out, int* out_bytes);
+extern int zs_deflate_flush(char* stream, int flush, void* out, int* out_bytes);
+// Changes the level and strategy of the stream. If the strategy or the
+// compression function changes, the data compressed so far is flushed into out
+// with Z_BLOCK first. Returns Z_BUF_ERROR if out is too small,
+// in which case the call should be retried with more output space.
+extern int zs_deflate_params(char* stream, int level, int strategy, void* out,
+                             int* out_bytes);
+// Calls deflateTune. A zero argument keeps the current value of the parameter.
+extern int zs_deflate_tune(char* stream, int good_length, int max_lazy,
+                           int nice_length, int max_chain);
+extern int zs_deflate_finish(char* stream, void* out, int* out_bytes);
+
+// Resets the stream and compresses in[0,in_bytes) into out, using dict as the
+// preset dictionary. If last=0, the output ends with a sync flush marker.
+// Otherwise it ends the deflate stream. out_bytes is updated to the number of
+// unused bytes in out. Returns Z_BUF_ERROR if out is too small.
+extern int zs_deflate_block(char* stream, void* dict, int dict_bytes, void* in,
+                            int in_bytes, void* out, int* out_bytes, int last);
+extern int zs_deflate_free(char* stream);
+
+// Returns the adler field of the stream. After inflate returns Z_NEED_DICT, it
+// is the Adler-32 checksum of the dictionary.
+extern unsigned zs_get_adler(char* stream);
+
+// Return the total_in and total_out fields of the stream.
+extern long long zs_get_total_in(char* stream);
+extern long long zs_get_total_out(char* stream);
+
+// Return the msg field of the stream. It may be NULL.
+extern const char* zs_get_msg(char* stream);
+
+// Compresses in[0,in_bytes) into out in one shot. On entry, *out_bytes is the
+// size of out. On return, it is the size of the compressed data. Returns
+// Z_BUF_ERROR if out is too small.
+extern int zs_compress(int level, int window_bits, void* in, size_t in_bytes,
+                       void* out, size_t* out_bytes);
+
+// Inflates from in into out. Unlike zs_inflate, the stream does not keep a
+// reference to in after the call. On return, *in_bytes and *out_bytes are set
+// to the number of unused bytes in in and out, respectively.
+extern int zs_inflate_buf(char* stream, void* in, size_t* in_bytes, void* out,
+                          size_t* out_bytes);
 
 extern int zs_get_errno();
 